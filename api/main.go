@@ -21,11 +21,22 @@ package main
 //   "password": "newpassword" }
 
 import "bytes"
+import "crypto/hmac"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "encoding/hex"
 import "encoding/json"
+import "errors"
+import "hash"
+import "io"
+import "io/ioutil"
 import "log"
 import "math/rand"
 import "net/http"
 import "net/url"
+import "regexp"
+import "strconv"
 import "strings"
 import "time"
 
@@ -44,6 +55,10 @@ import "github.com/fasthttp/router"
 // Configuration
 import "github.com/knadh/koanf"
 
+// Feed parsing
+import "github.com/mmcdole/gofeed"
+import "golang.org/x/net/html"
+
 // MemStats
 import "runtime"
 
@@ -57,12 +72,34 @@ import "github.com/stevemeier/rssmix/lib"
 type Compilation struct {
 	Id		string		`json:"id"`
 	Urls		[]string	`json:"urls"`
+	Sources		[]lib.Source	`json:"sources,omitempty"`
+	Feeds		[]FeedHealth	`json:"feeds,omitempty"`
+	Credentials	map[string]lib.Credentials	`json:"credentials,omitempty"`
 	Password	string		`json:"password,omitempty"`
 	Name		string		`json:"name"`
 	Filter		struct {
 		Include []string	`json:"include"`
 		Exclude []string	`json:"exclude"`
+		Expression string	`json:"expression"`
 	}				`json:"filter"`
+	Filters		map[string]string	`json:"filters,omitempty"`
+	Mirror		Mirror		`json:"mirror"`
+	Formats		[]string	`json:"formats"`
+	Dedup		Dedup		`json:"dedup"`
+	Rewrite		lib.Rewrite	`json:"rewrite"`
+	Podcast		lib.Podcast	`json:"podcast"`
+}
+
+// Enclosure mirroring, the quota is in megabytes (0 for the server default)
+type Mirror struct {
+	Enabled		bool		`json:"enabled"`
+	Quota		int64		`json:"quota"`
+}
+
+// Removal of items carried by more than one feed, no keys disable it
+type Dedup struct {
+	Keys		[]string	`json:"keys"`
+	Keep		string		`json:"keep"`
 }
 
 type Feed struct {
@@ -71,22 +108,59 @@ type Feed struct {
 	URN		string
 }
 
+// Fetch status of a feed, as recorded by fetcher
+type FeedHealth struct {
+	Url		string		`json:"url"`
+	Active		bool		`json:"active"`
+	Refreshed	int64		`json:"refreshed"`
+	Updated		int64		`json:"updated"`
+	LastSuccess	int64		`json:"last_success"`
+	LastStatus	int64		`json:"last_status"`
+	LastError	string		`json:"last_error"`
+	Failures	int64		`json:"failures"`
+}
+
+// A feed linked from an HTML page
+type FeedCandidate struct {
+	Url		string		`json:"url"`
+	Type		string		`json:"type"`
+	Title		string		`json:"title,omitempty"`
+}
+
 type Changeset struct {
 	Add		[]string	`json:"add"`
+	Sources		[]lib.Source	`json:"sources"`
 	Delete		[]string	`json:"delete"`
+	Credentials	map[string]lib.Credentials	`json:"credentials"`
 	Password	string		`json:"password"`
 	Name		string		`json:"name"`
 	Filter		struct {
 		Include []string	`json:"include"`
 		Exclude []string	`json:"exclude"`
+		// An empty expression removes it
+		Expression *string	`json:"expression"`
 	}				`json:"filter"`
+	// Filter expressions by feed URL, an empty one removes the filter
+	Filters		map[string]string	`json:"filters"`
+	Mirror		*Mirror		`json:"mirror"`
+	Formats		[]string	`json:"formats"`
+	Dedup		*Dedup		`json:"dedup"`
+	Rewrite		*lib.Rewrite	`json:"rewrite"`
+	Podcast		*lib.Podcast	`json:"podcast"`
 }
 
 // Global variables
 var version string
 var database *sqlx.DB
+var storage lib.Storage
+var guard *lib.AddressGuard
+var transport *http.Transport
 var k = koanf.New(".")
 
+// Metrics
+var api_requests = lib.NewCounter("rssmix_api_requests_total", "API requests by route, method and status", "route", "method", "status")
+var api_duration = lib.NewHistogram("rssmix_api_request_duration_seconds", "Time taken to handle API requests by route", lib.LatencyBuckets, "route")
+
 func main () {
 	log.Printf("Version: %s\n", version)
 
@@ -94,14 +168,29 @@ func main () {
 	k = lib.LoadConfig("api")
 	log.Printf("Loaded config from %s\n", k.String("configfile"))
 
+	// URLs are probed on behalf of users, so keep them away from internal addresses
+	var guarderr error
+	guard, guarderr = lib.NewAddressGuard(k)
+	if guarderr != nil { log.Fatal(guarderr) }
+	transport = guard.Transport()
+
 	// Set up HTTP routes
 	routes := router.New()
+	// Used as metrics label, so we don't get one per compilation ID
+	routes.SaveMatchedRoutePath = true
 	routes.POST("/v1/compilation", http_handler_new_compilation)
 	routes.GET("/v1/compilation/{id}", http_handler_get_compilation)
 	routes.DELETE("/v1/compilation/{id}", http_handler_delete_compilation)
 	routes.PATCH("/v1/compilation/{id}", http_handler_update_compilation)
+	routes.POST("/v1/compilation/{id}/refresh", http_handler_refresh_compilation)
+	routes.GET("/v1/discover", http_handler_discover)
+	routes.GET("/v1/websub/{id}", http_handler_websub_verify)
+	routes.POST("/v1/websub/{id}", http_handler_websub_content)
 	routes.POST("/v1/admin/cleanup_feed", http_handler_cleanup_feed)
+	routes.POST("/v1/admin/gc", http_handler_gc)
+	routes.POST("/v1/admin/refresh_feed/{id}", http_handler_refresh_feed)
 	routes.GET("/v1/admin/memstats", http_handler_get_memstats)
+	routes.GET("/metrics", http_handler_metrics)
 	routes.GET("/v1/admin/version", http_handler_get_version)
 	routes.ANY("/", http_handler_unknown_path)
 	routes.ANY("/(.*)", http_handler_unknown_path)
@@ -112,11 +201,16 @@ func main () {
 	if dberr != nil { log.Fatal(dberr) }
 	defer database.Close()
 
+	// Feed storage, for content pushed via WebSub
+	var storeerr error
+	storage, storeerr = lib.OpenStorage(k, database)
+	if storeerr != nil { log.Fatal(storeerr) }
+
 	log.Println("Starting HTTP server")
 	listener, lsterr := reuseport.Listen(k.String("listen.family"), k.String("listen.address"))
 	if lsterr != nil { log.Fatal(lsterr) }
 	log.Printf("Listening on %s\n", listener.Addr().String())
-	httperr := fasthttp.Serve(listener, routes.Handler)
+	httperr := fasthttp.Serve(listener, count_requests(routes.Handler))
 	if httperr != nil {
 		log.Fatal(httperr)
 	}
@@ -152,6 +246,170 @@ func http_handler_cleanup_feed (ctx *fasthttp.RequestCtx) {
 	if werr != nil { log.Printf("ctx.Write failed in http_handler_cleanup_feed: %s\n", werr) }
 }
 
+// Removes orphaned rows and stored feeds, see `lib.Collect_garbage`
+func http_handler_gc (ctx *fasthttp.RequestCtx) {
+	log_request(ctx)
+	ctx.Response.Header.Set("Content-Type", "application/json")
+
+	configerr := lib.Check_gc_config(k)
+	if configerr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error":configerr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_gc: %s\n", werr) }
+		return
+	}
+
+	dryrun := ctx.QueryArgs().GetBool("dryrun")
+	minage := time.Duration(lib.Value_or_default(k.Int("gc.minage"), 60).(int)) * time.Minute
+	report, gcerr := lib.Collect_garbage(database, storage, minage, dryrun)
+
+	var response []byte
+	if gcerr == nil {
+		log.Printf("Garbage collection (dry run: %t) removed %d files, %d outputs, %d bytes\n", dryrun, len(report.Files), len(report.Outputs), report.Bytes)
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		response, _ = json.Marshal(report)
+	} else {
+		log.Printf("Garbage collection failed: %s\n", gcerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		response, _ = json.Marshal(map[string]string{"error":gcerr.Error()})
+	}
+
+	_, werr := ctx.Write(response)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_gc: %s\n", werr) }
+}
+
+// Queues a single feed for an immediate refresh, and the compilations containing it
+// for recompilation. Unlike the public variant, this is not rate-limited.
+func http_handler_refresh_feed (ctx *fasthttp.RequestCtx) {
+	log_request(ctx)
+	ctx.Response.Header.Set("Content-Type", "application/json")
+
+	feedid, converr := strconv.ParseInt(ctx.UserValue("id").(string), 10, 64)
+	if converr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": "Feed ID must be numeric"})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_refresh_feed: %s\n", werr) }
+		return
+	}
+
+	var count int64
+	scanerr := database.QueryRow("SELECT COUNT(*) FROM feed_status WHERE id = ?", feedid).Scan(&count)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	if count == 0 {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	now := time.Now().Unix()
+	_, execerr := database.Exec("UPDATE feed_status SET refresh_requested = ? WHERE id = ?", now, feedid)
+	if execerr != nil {
+		log.Printf("[%d] Database error: %s\n", feedid, execerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	_, execerr = database.Exec("UPDATE compilation_status SET refresh_requested = ? WHERE id IN (SELECT id FROM compilation_content WHERE feed_id = ?)", now, feedid)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+
+	log.Printf("[%d] Feed queued for refresh\n", feedid)
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+	response, _ := json.Marshal(map[string]int64{"id": feedid})
+	_, werr := ctx.Write(response)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_refresh_feed: %s\n", werr) }
+}
+
+// Queues all feeds of a compilation for an immediate refresh, after which
+// compiler rebuilds it. Limited to once every `refresh.ratelimit` seconds.
+func http_handler_refresh_compilation (ctx *fasthttp.RequestCtx) {
+	log_request(ctx)
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	cplid := trim_extension(ctx.UserValue("id").(string))
+	userpw := string(ctx.QueryArgs().Peek("password"))
+
+	if !compilation_exists(cplid) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	// Retrieve the password for the compilation
+	cplpw := compilation_password(cplid)
+
+	if len(cplpw) > 0 && userpw == "" {
+		// Compilation has a password but none was provided
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	if len(cplpw) > 0 && userpw != cplpw {
+		// Password was provided but is wrong
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		return
+	}
+
+	tx, txerr := database.Begin()
+	if txerr != nil {
+		log.Println(txerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Compilations which were never compiled may have no status yet, and are not rate-limited
+	var statusrows int
+	statuserr := tx.QueryRow("SELECT COUNT(*) FROM compilation_status WHERE id = ?", cplid).Scan(&statusrows)
+	if statuserr == nil && statusrows == 0 {
+		_, statuserr = tx.Exec("INSERT INTO compilation_status (id, updated, published, refresh_requested) VALUES (?, 0, 0, 0)", cplid)
+	}
+	if statuserr != nil {
+		log.Printf("[%s] Database error: %s\n", cplid, statuserr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Only succeeds if the last refresh is long enough ago, so concurrent requests can't sneak through
+	now := time.Now().Unix()
+	ratelimit := int64(lib.Value_or_default(k.Int("refresh.ratelimit"), 300).(int))
+	result, execerr := tx.Exec("UPDATE compilation_status SET refresh_requested = ? WHERE id = ? AND COALESCE(refresh_requested,0) <= ?", now, cplid, now - ratelimit)
+	if execerr != nil {
+		log.Printf("[%s] Database error: %s\n", cplid, execerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	if rowcount, _ := result.RowsAffected(); rowcount == 0 {
+		var requested int64
+		scanerr := tx.QueryRow("SELECT COALESCE(refresh_requested,0) FROM compilation_status WHERE id = ?", cplid).Scan(&requested)
+		if scanerr != nil { log.Printf("[%s] Database error: %s\n", cplid, scanerr) }
+		ctx.Response.Header.Set("Retry-After", strconv.FormatInt(requested + ratelimit - now, 10))
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		response, _ := json.Marshal(map[string]string{"error": "Compilation was refreshed recently, please try again later"})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_refresh_compilation: %s\n", werr) }
+		return
+	}
+
+	result, execerr = tx.Exec("UPDATE feed_status SET refresh_requested = ? WHERE id IN (SELECT feed_id FROM compilation_content WHERE id = ?)", now, cplid)
+	if execerr != nil {
+		log.Printf("[%s] Database error: %s\n", cplid, execerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	queued, _ := result.RowsAffected()
+
+	commiterr := tx.Commit()
+	if commiterr != nil {
+		log.Println(commiterr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Compilation queued for refresh (%d feeds)\n", cplid, queued)
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+	response, _ := json.Marshal(map[string]interface{}{"id": cplid, "feeds": queued})
+	_, werr := ctx.Write(response)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_refresh_compilation: %s\n", werr) }
+}
+
 func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 	log_request(ctx)
 	var changes Changeset
@@ -165,7 +423,7 @@ func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	cplid := trim_dotrss(ctx.UserValue("id").(string))
+	cplid := trim_extension(ctx.UserValue("id").(string))
 	userpw := string(ctx.QueryArgs().Peek("password"))
 
 	if !compilation_exists(cplid) {
@@ -188,9 +446,172 @@ func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if len(changes.Credentials) > 0 && k.String("credentials.key") == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": "Feed credentials are not supported by this server"})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+		return
+	}
+
+	if changes.Mirror != nil {
+		mirrorerr := validate_mirror(*changes.Mirror)
+		if mirrorerr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": mirrorerr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+	}
+
+	formaterr := validate_formats(changes.Formats)
+	if formaterr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": formaterr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+		return
+	}
+
+	var expression string
+	if changes.Filter.Expression != nil { expression = *changes.Filter.Expression }
+	filter_expr, filtererr := validate_filter(changes.Filter.Include, changes.Filter.Exclude, expression)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+		return
+	}
+
+	feedfilters, filtererr := validate_feed_filters(changes.Filters)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+		return
+	}
+
+	if changes.Dedup != nil {
+		deduperr := validate_dedup(*changes.Dedup)
+		if deduperr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": deduperr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+	}
+
+	if changes.Rewrite != nil {
+		rewriteerr := changes.Rewrite.Validate()
+		if rewriteerr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": rewriteerr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+	}
+
+	if changes.Podcast != nil {
+		podcasterr := changes.Podcast.Validate()
+		if podcasterr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": podcasterr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+	}
+
+	// Either may change, so check the result against what is stored
+	if changes.Podcast != nil || len(changes.Formats) > 0 {
+		var formats string
+		var podcast string
+		scanerr := database.QueryRow("SELECT COALESCE(formats,''), COALESCE(podcast,'') FROM compilation WHERE id = ?", cplid).Scan(&formats, &podcast)
+		if scanerr != nil { log.Printf("[%s] Database error: %s\n", cplid, scanerr) }
+
+		var settings lib.Podcast
+		if changes.Podcast != nil {
+			settings = *changes.Podcast
+		} else if loaded, loaderr := lib.Load_podcast(podcast); loaderr == nil {
+			settings = *loaded
+		}
+		if len(changes.Formats) > 0 { formats = strings.Join(changes.Formats, ",") }
+
+		podcasterr := validate_podcast_formats(settings, lib.Parse_formats(formats))
+		if podcasterr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": podcasterr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+	}
+
+	// New URLs may need to be discovered first, which can fail or be ambiguous
+	addids := make(map[string]int64)
+	ambiguous := make(map[string][]FeedCandidate)
+	for _, url := range changes.Add {
+		if creds, ok := changes.Credentials[url]; ok && !creds.Empty() {
+			feedid, caterr := catalogue_private_feed(url, creds)
+			if caterr != nil {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				response, _ := json.Marshal(map[string]string{"error": caterr.Error()})
+				_, werr := ctx.Write(response)
+				if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+				return
+			}
+			addids[url] = feedid
+			continue
+		}
+
+		feedid, candidates, caterr := catalogue_feed(url)
+		if caterr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": caterr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+		if len(candidates) > 0 {
+			ambiguous[url] = candidates
+			continue
+		}
+		addids[url] = feedid
+	}
+	if len(ambiguous) > 0 {
+		write_candidates(ctx, ambiguous)
+		return
+	}
+	var sourceids []int64
+	for _, src := range changes.Sources {
+		feedid, caterr := catalogue_source(src)
+		if caterr != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": caterr.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+			return
+		}
+		sourceids = append(sourceids, feedid)
+	}
+	filterids, filtererr := filter_feed_ids(cplid, feedfilters, addids, changes.Sources, sourceids)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_update_compilation: %s\n", werr) }
+		return
+	}
+
 	// Now we can modify the compilation
 	// Three things can be modified:
 	// - "add" contains an array of new feed URLs (just like in new compilation)
+	//   "sources" contains pages and APIs to be turned into feeds
 	// - "delete" contains an array of URL to be removed from compilation
 	// - "password" set or change the password
 	tx, txerr := database.Begin()
@@ -203,29 +624,28 @@ func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 
 	if len(changes.Add) > 0 {
 		// works
-		for _, url := range changes.Add {
-			var exists bool
-			var feedid int64
-			exists, feedid = url_in_catalogue(url)
-			if !exists {
-				_, feedid, _ = add_feed_to_catalogue(url)
-			}
+		for _, feedid := range addids {
 			_, execerr := tx.Exec("INSERT INTO compilation_content (id, feed_id) VALUES (?, ?)", cplid, feedid)
 			if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 		}
 	}
+	for _, feedid := range sourceids {
+		_, execerr := tx.Exec("INSERT INTO compilation_content (id, feed_id) VALUES (?, ?)", cplid, feedid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
 	if len(changes.Delete) > 0 {
-		// works
+		// Removes feeds and sources with this URL alike
 		for _, url := range changes.Delete {
-			var exists bool
-			var feedid int64
-			exists, feedid = url_in_catalogue(url)
-			if exists {
-				_, execerr := tx.Exec("DELETE FROM compilation_content WHERE id = ? AND feed_id = ?", cplid, feedid)
-				if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
-			}
+			schema, urn, normerr := lib.Normalize_url(url)
+			if normerr != nil { continue }
+			_, execerr := tx.Exec("DELETE FROM compilation_content WHERE id = ? AND feed_id IN (SELECT id FROM feed WHERE uschema = ? AND urn = ?)", cplid, schema, urn)
+			if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 		}
 	}
+	for url, feedid := range filterids {
+		execerr := set_feed_filter(tx, cplid, feedid, feedfilters[url])
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
 	if changes.Password != "" {
 		// works
 		_, execerr := tx.Exec("UPDATE compilation SET password = ? WHERE id = ?", changes.Password, cplid)
@@ -236,11 +656,42 @@ func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 	}
 	if len(changes.Filter.Include) > 0 {
-		_, execerr := tx.Exec("UPDATE compilation SET filter_inc = ? WHERE id = ?", strings.Join(changes.Filter.Include, ","), cplid)
+		_, execerr := tx.Exec("UPDATE compilation SET filter_inc = ? WHERE id = ?", lib.Join_patterns(changes.Filter.Include), cplid)
 		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 	}
 	if len(changes.Filter.Exclude) > 0 {
-		_, execerr := tx.Exec("UPDATE compilation SET filter_exc = ? WHERE id = ?", strings.Join(changes.Filter.Exclude, ","), cplid)
+		_, execerr := tx.Exec("UPDATE compilation SET filter_exc = ? WHERE id = ?", lib.Join_patterns(changes.Filter.Exclude), cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if changes.Filter.Expression != nil {
+		_, execerr := tx.Exec("UPDATE compilation SET filter_expr = ? WHERE id = ?", filter_expr, cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if changes.Mirror != nil {
+		// Fetcher removes mirrored enclosures once a compilation stops mirroring
+		_, execerr := tx.Exec("UPDATE compilation SET mirror = ?, mirror_quota = ? WHERE id = ?", bool_to_int(changes.Mirror.Enabled), changes.Mirror.Quota, cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if len(changes.Formats) > 0 {
+		_, execerr := tx.Exec("UPDATE compilation SET formats = ? WHERE id = ?", strings.Join(changes.Formats, ","), cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+		// Rebuild, so outputs in new formats exist right away
+		_, execerr = tx.Exec("UPDATE compilation_status SET updated = 0 WHERE id = ?", cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if changes.Dedup != nil {
+		_, execerr := tx.Exec("UPDATE compilation SET dedup = ?, dedup_keep = ? WHERE id = ?", strings.Join(changes.Dedup.Keys, ","), changes.Dedup.Keep, cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if changes.Rewrite != nil {
+		_, execerr := tx.Exec("UPDATE compilation SET rewrite = ? WHERE id = ?", rewrite_column(*changes.Rewrite), cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	if changes.Podcast != nil {
+		_, execerr := tx.Exec("UPDATE compilation SET podcast = ? WHERE id = ?", podcast_column(*changes.Podcast), cplid)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+		// Rebuild, so the channel changes right away
+		_, execerr = tx.Exec("UPDATE compilation_status SET updated = 0 WHERE id = ?", cplid)
 		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 	}
 
@@ -255,9 +706,8 @@ func http_handler_update_compilation (ctx *fasthttp.RequestCtx) {
 }
 
 func http_handler_delete_compilation (ctx *fasthttp.RequestCtx) {
-	var execerr error
 	log_request(ctx)
-	cplid := trim_dotrss(ctx.UserValue("id").(string))
+	cplid := trim_extension(ctx.UserValue("id").(string))
 	userpw := string(ctx.QueryArgs().Peek("password"))
 
 	if !compilation_exists(cplid) {
@@ -288,10 +738,13 @@ func http_handler_delete_compilation (ctx *fasthttp.RequestCtx) {
 	}
 	defer tx.Rollback()
 
-	_, execerr = tx.Exec("DELETE FROM compilation_content WHERE id = ?", cplid)
-	if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
-	_, execerr = tx.Exec("DELETE FROM compilation WHERE id = ?", cplid)
-	if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	// Outputs are left to garbage collection
+	removeerr := lib.Remove_compilation(tx, cplid)
+	if removeerr != nil {
+		log.Printf("[%s] Database error: %s\n", cplid, removeerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
 
 	commiterr := tx.Commit()
 	if commiterr != nil {
@@ -320,27 +773,139 @@ func http_handler_new_compilation (ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if len(newcpl.Credentials) > 0 && k.String("credentials.key") == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": "Feed credentials are not supported by this server"})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	mirrorerr := validate_mirror(newcpl.Mirror)
+	if mirrorerr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": mirrorerr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	formaterr := validate_formats(newcpl.Formats)
+	if formaterr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": formaterr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+	formats := lib.Parse_formats(strings.Join(newcpl.Formats, ","))
+
+	filter_expr, filtererr := validate_filter(newcpl.Filter.Include, newcpl.Filter.Exclude, newcpl.Filter.Expression)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	feedfilters, filtererr := validate_feed_filters(newcpl.Filters)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	deduperr := validate_dedup(newcpl.Dedup)
+	if deduperr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": deduperr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	rewriteerr := newcpl.Rewrite.Validate()
+	if rewriteerr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": rewriteerr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
+	podcasterr := newcpl.Podcast.Validate()
+	if podcasterr == nil { podcasterr = validate_podcast_formats(newcpl.Podcast, formats) }
+	if podcasterr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": podcasterr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
+	}
+
 	cplid := generate_id(k.Int("id.length"))
 
 	// get the IDs for the feeds
 	url2feedid := make(map[string]int64)
+	ambiguous := make(map[string][]FeedCandidate)
 	for _, url := range newcpl.Urls {
-		exists, feedid := url_in_catalogue(url)
-		if exists {
-			url2feedid[url] = feedid
-		} else {
-			created, feedid, err := add_feed_to_catalogue(url)
-			if created {
-				url2feedid[url] = feedid
-			} else {
+		if creds, ok := newcpl.Credentials[url]; ok && !creds.Empty() {
+			feedid, err := catalogue_private_feed(url, creds)
+			if err != nil {
 				ctx.SetStatusCode(fasthttp.StatusBadRequest)
 				response, _ := json.Marshal(map[string]string{"error": err.Error()})
 				_, werr := ctx.Write(response)
 				if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
 				return
 			}
+			url2feedid[url] = feedid
+			continue
+		}
+
+		feedid, candidates, err := catalogue_feed(url)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": err.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+			return
+		}
+		if len(candidates) > 0 {
+			ambiguous[url] = candidates
+			continue
 		}
-		log.Printf("Checking %s -> %t -> %d\n", url, exists, feedid)
+		url2feedid[url] = feedid
+		log.Printf("Checking %s -> %d\n", url, feedid)
+	}
+
+	// Let the client choose, if a page links to more than one feed
+	if len(ambiguous) > 0 {
+		write_candidates(ctx, ambiguous)
+		return
+	}
+
+	var sourceids []int64
+	for _, src := range newcpl.Sources {
+		feedid, err := catalogue_source(src)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"error": err.Error()})
+			_, werr := ctx.Write(response)
+			if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+			return
+		}
+		sourceids = append(sourceids, feedid)
+	}
+	filterids, filtererr := filter_feed_ids("", feedfilters, url2feedid, newcpl.Sources, sourceids)
+	if filtererr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": filtererr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
+		return
 	}
 
 	// in one swoop transaction, add the compilation and its content
@@ -352,16 +917,26 @@ func http_handler_new_compilation (ctx *fasthttp.RequestCtx) {
 	}
 	defer tx.Rollback()
 
-	_, execerr = tx.Exec("INSERT INTO compilation (id, password, name, filter_inc, filter_exc) VALUES (?, ?, ?, ?, ?)", cplid, newcpl.Password, lib.Maxlen(newcpl.Name, 127),
-                                                                                                                            strings.Join(newcpl.Filter.Include,","), strings.Join(newcpl.Filter.Exclude,","))
+	_, execerr = tx.Exec("INSERT INTO compilation (id, password, name, filter_inc, filter_exc, filter_expr, mirror, mirror_quota, formats, dedup, dedup_keep, rewrite, podcast) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", cplid, newcpl.Password, lib.Maxlen(newcpl.Name, 127),
+                                                                                                                            lib.Join_patterns(newcpl.Filter.Include), lib.Join_patterns(newcpl.Filter.Exclude), filter_expr,
+															    bool_to_int(newcpl.Mirror.Enabled), newcpl.Mirror.Quota, strings.Join(formats, ","),
+															    strings.Join(newcpl.Dedup.Keys, ","), newcpl.Dedup.Keep, rewrite_column(newcpl.Rewrite), podcast_column(newcpl.Podcast))
 	if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 	for _, value := range url2feedid {
 		_, execerr = tx.Exec("INSERT INTO compilation_content (id, feed_id) VALUES (?, ?)", cplid, value)
 		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 	}
+	for _, value := range sourceids {
+		_, execerr = tx.Exec("INSERT INTO compilation_content (id, feed_id) VALUES (?, ?)", cplid, value)
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
+	for url, feedid := range filterids {
+		execerr = set_feed_filter(tx, cplid, feedid, feedfilters[url])
+		if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
+	}
 
 	// Add it to compilation_status as well, otherwise compiler will not pick it up
-	_, execerr = tx.Exec("INSERT INTO compilation_status VALUES (?, 0, 0)", cplid)
+	_, execerr = tx.Exec("INSERT INTO compilation_status (id, updated, published) VALUES (?, 0, 0)", cplid)
 	if execerr != nil { log.Printf("[%s] Database error: %s\n", cplid, execerr) }
 
 	commiterr := tx.Commit()
@@ -378,7 +953,12 @@ func http_handler_new_compilation (ctx *fasthttp.RequestCtx) {
 	}
 
 	ctx.SetStatusCode(fasthttp.StatusCreated)
-	response, _ := json.Marshal(map[string]string{"url": url_from_id(cplid)})
+	// `url` is kept for clients which only know about RSS
+	urls := make(map[string]string)
+	for _, format := range formats {
+		urls[format] = url_from_id(cplid, format)
+	}
+	response, _ := json.Marshal(map[string]interface{}{"url": url_from_id(cplid, formats[0]), "urls": urls})
 	_, werr := ctx.Write(response)
 	if werr != nil { log.Printf("ctx.Write failed in http_handler_new_compilation: %s\n", werr) }
 	log.Printf("New compilation -> %s\n", cplid)
@@ -388,7 +968,7 @@ func http_handler_get_compilation (ctx *fasthttp.RequestCtx) {
 	var scanerr error
 	log_request(ctx)
 	ctx.Response.Header.Set("Content-Type", "application/json")
-	cplid := trim_dotrss(ctx.UserValue("id").(string))
+	cplid := trim_extension(ctx.UserValue("id").(string))
 
 	if len(cplid) > k.Int("id.length") {
 		// ID length is 10, so longer can not exist
@@ -404,17 +984,44 @@ func http_handler_get_compilation (ctx *fasthttp.RequestCtx) {
 	var thiscpl Compilation
 	var filter_inc string
 	var filter_exc string
-	scanerr = database.QueryRow("SELECT id, name, COALESCE(filter_inc,''), COALESCE(filter_exc,'') FROM compilation WHERE id = ?", cplid).Scan(&thiscpl.Id, &thiscpl.Name, &filter_inc, &filter_exc)
+	var filter_expr string
+	var mirror int64
+	var formats string
+	var dedup string
+	var rewrite string
+	var podcast string
+	scanerr = database.QueryRow(`SELECT id, name, COALESCE(filter_inc,''), COALESCE(filter_exc,''), COALESCE(filter_expr,''), COALESCE(mirror,0), COALESCE(mirror_quota,0),
+				     COALESCE(formats,''), COALESCE(dedup,''), COALESCE(dedup_keep,''), COALESCE(rewrite,''), COALESCE(podcast,'') FROM compilation WHERE id = ?`, cplid).Scan(&thiscpl.Id, &thiscpl.Name, &filter_inc, &filter_exc, &filter_expr, &mirror, &thiscpl.Mirror.Quota,
+																						       &formats, &dedup, &thiscpl.Dedup.Keep, &rewrite, &podcast)
 	if scanerr != nil { log.Printf("[%s] Database error: %s\n", cplid, scanerr) }
+	thiscpl.Mirror.Enabled = mirror > 0
+	thiscpl.Formats = lib.Parse_formats(formats)
+	thiscpl.Dedup.Keys = lib.Parse_dedup(dedup)
+	if thiscpl.Dedup.Keys == nil { thiscpl.Dedup.Keys = []string{} }
+	if thiscpl.Dedup.Keep == "" { thiscpl.Dedup.Keep = "oldest" }
+	if len(rewrite) > 0 {
+		rules, loaderr := lib.Load_rewrite(rewrite)
+		if loaderr == nil { thiscpl.Rewrite = *rules }
+	}
+	if len(podcast) > 0 {
+		settings, loaderr := lib.Load_podcast(podcast)
+		if loaderr == nil { thiscpl.Podcast = *settings }
+	}
 
 	// To get an empty array, we init it first and only split the DB data, if it's not empty
-	thiscpl.Filter.Include = []string{}
-	thiscpl.Filter.Exclude = []string{}
-	if len(filter_inc) > 0 { thiscpl.Filter.Include = strings.Split(filter_inc, ",") }
-	if len(filter_exc) > 0 { thiscpl.Filter.Exclude = strings.Split(filter_exc, ",") }
+	thiscpl.Filter.Include = lib.Split_patterns(filter_inc)
+	thiscpl.Filter.Exclude = lib.Split_patterns(filter_exc)
+	if len(filter_expr) > 0 {
+		expr, loaderr := lib.Load_filter(filter_expr)
+		if loaderr == nil { thiscpl.Filter.Expression = expr.String() }
+	}
 
-	rows, qerr := database.Query(`SELECT feed.uschema, feed.urn FROM feed
+	rows, qerr := database.Query(`SELECT feed.uschema, feed.urn, COALESCE(feed.source,'feed'), COALESCE(feed.mapping,''),
+				      COALESCE(feed_status.active,0), COALESCE(feed_status.refreshed,0), COALESCE(feed_status.updated,0),
+				      COALESCE(feed_status.last_success,0), COALESCE(feed_status.last_status,0),
+				      COALESCE(feed_status.last_error,''), COALESCE(feed_status.failures,0), COALESCE(compilation_content.filter_expr,'') FROM feed
 				      INNER JOIN compilation_content ON feed.id=compilation_content.feed_id
+				      LEFT JOIN feed_status ON feed.id=feed_status.id
 				      WHERE compilation_content.id = ?`, cplid)
 	if qerr != nil {
 		log.Printf("[%s] Database error: %s\n", cplid, qerr)
@@ -425,10 +1032,32 @@ func http_handler_get_compilation (ctx *fasthttp.RequestCtx) {
 	for rows.Next() {
 		var schema string
 		var urn string
-		scanerr = rows.Scan(&schema, &urn)
-		if scanerr == nil {
+		var source string
+		var mapping string
+		var health FeedHealth
+		var active int64
+		var feedfilter string
+		scanerr = rows.Scan(&schema, &urn, &source, &mapping, &active, &health.Refreshed, &health.Updated,
+				    &health.LastSuccess, &health.LastStatus, &health.LastError, &health.Failures, &feedfilter)
+		if scanerr == nil && source != "feed" {
+			thissrc := lib.Source{Url: schema+"://"+urn, Type: source}
+			jderr := json.Unmarshal([]byte(mapping), &thissrc.Mapping)
+			if jderr != nil { log.Printf("[%s] Invalid mapping for %s: %s\n", cplid, thissrc.Url, jderr) }
+			thiscpl.Sources = append(thiscpl.Sources, thissrc)
+		} else if scanerr == nil {
 			thiscpl.Urls = append(thiscpl.Urls, schema+"://"+urn)
 		}
+		if scanerr == nil {
+			health.Url = schema+"://"+urn
+			health.Active = active > 0
+			thiscpl.Feeds = append(thiscpl.Feeds, health)
+		}
+		if scanerr == nil && feedfilter != "" {
+			expr, loaderr := lib.Load_filter(feedfilter)
+			if loaderr != nil { continue }
+			if thiscpl.Filters == nil { thiscpl.Filters = make(map[string]string) }
+			thiscpl.Filters[schema+"://"+urn] = expr.String()
+		}
 	}
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
@@ -437,6 +1066,135 @@ func http_handler_get_compilation (ctx *fasthttp.RequestCtx) {
 	if werr != nil { log.Printf("ctx.Write failed in http_handler_get_compilation: %s\n", werr) }
 }
 
+// WebSub hubs call this to verify that we really requested a (un)subscription
+func http_handler_websub_verify (ctx *fasthttp.RequestCtx) {
+	log_request(ctx)
+	feedid, converr := strconv.ParseInt(ctx.UserValue("id").(string), 10, 64)
+	if converr != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	mode := string(ctx.QueryArgs().Peek("hub.mode"))
+	topic := string(ctx.QueryArgs().Peek("hub.topic"))
+	challenge := ctx.QueryArgs().Peek("hub.challenge")
+
+	var ourtopic string
+	var requested int64
+	scanerr := database.QueryRow("SELECT topic, COALESCE(requested,0) FROM websub WHERE id = ?", feedid).Scan(&ourtopic, &requested)
+	if scanerr != nil && scanerr != sql.ErrNoRows { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	// Only a request of fetcher within the last hour can be verified, anything else we never asked for
+	if scanerr != nil || ourtopic != topic || requested < time.Now().Add(-time.Hour).Unix() {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	var execerr error
+	switch mode {
+	case "subscribe":
+		maxlease := int64(lib.Value_or_default(k.Int("websub.maxlease"), 864000).(int))
+		lease, _ := strconv.ParseInt(string(ctx.QueryArgs().Peek("hub.lease_seconds")), 10, 64)
+		if lease <= 0 || lease > maxlease { lease = maxlease }
+		_, execerr = database.Exec("UPDATE websub SET verified = 1, requested = 0, lease_expires = ? WHERE id = ?", time.Now().Unix() + lease, feedid)
+		log.Printf("[%d] WebSub subscription verified for %d seconds\n", feedid, lease)
+	case "denied":
+		_, execerr = database.Exec("DELETE FROM websub WHERE id = ?", feedid)
+		log.Printf("[%d] WebSub subscription denied\n", feedid)
+	default:
+		// fetcher never unsubscribes
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	if execerr != nil {
+		log.Printf("[%d] Database error: %s\n", feedid, execerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, werr := ctx.Write(challenge)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_websub_verify: %s\n", werr) }
+}
+
+// WebSub hubs push new content of a feed here
+func http_handler_websub_content (ctx *fasthttp.RequestCtx) {
+	log.Printf("%s %s (%d bytes)\n", ctx.Method(), ctx.Path(), len(ctx.PostBody()))
+	feedid, converr := strconv.ParseInt(ctx.UserValue("id").(string), 10, 64)
+	if converr != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	var secret string
+	var filename string
+	scanerr := database.QueryRow(`SELECT COALESCE(websub.secret,''), COALESCE(feed.filename,'') FROM websub
+				      INNER JOIN feed ON feed.id = websub.id
+				      WHERE websub.id = ? AND websub.verified > 0`, feedid).Scan(&secret, &filename)
+	if scanerr != nil {
+		if scanerr != sql.ErrNoRows { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+		// Tells the hub to stop sending us this
+		ctx.SetStatusCode(fasthttp.StatusGone)
+		return
+	}
+
+	// The spec wants a 2xx even if the signature is wrong, we just ignore the content
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+
+	if !valid_hub_signature(string(ctx.Request.Header.Peek("X-Hub-Signature")), secret, ctx.PostBody()) {
+		log.Printf("[%d] Ignoring WebSub content with invalid signature\n", feedid)
+		return
+	}
+
+	if filename == "" {
+		// Fetcher has not stored this feed yet
+		log.Printf("[%d] Ignoring WebSub content, feed has no file yet\n", feedid)
+		return
+	}
+
+	_, parseerr := gofeed.NewParser().Parse(bytes.NewReader(ctx.PostBody()))
+	if parseerr != nil {
+		log.Printf("[%d] Ignoring WebSub content, not a valid feed: %s\n", feedid, parseerr)
+		return
+	}
+
+	_, writeerr := storage.Put(filename, bytes.NewReader(ctx.PostBody()))
+	if writeerr != nil {
+		log.Printf("[%d] Could not store WebSub content: %s\n", feedid, writeerr)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	_, execerr := database.Exec("UPDATE feed_status SET updated = ?, refreshed = ? WHERE id = ?", time.Now().Unix(), time.Now().Unix(), feedid)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+	log.Printf("[%d] Stored %d bytes pushed via WebSub\n", feedid, len(ctx.PostBody()))
+}
+
+// Checks `X-Hub-Signature: method=signature` against our secret
+func valid_hub_signature (header string, secret string, body []byte) (bool) {
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 { return false }
+
+	var mac hash.Hash
+	switch strings.ToLower(parts[0]) {
+	case "sha1":
+		mac = hmac.New(sha1.New, []byte(secret))
+	case "sha256":
+		mac = hmac.New(sha256.New, []byte(secret))
+	case "sha384":
+		mac = hmac.New(sha512.New384, []byte(secret))
+	case "sha512":
+		mac = hmac.New(sha512.New, []byte(secret))
+	default:
+		return false
+	}
+	mac.Write(body)
+
+	signature, hexerr := hex.DecodeString(parts[1])
+	if hexerr != nil { return false }
+
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
 func compilation_exists (s string) (bool) {
 	var count int64
 	// If query fails, count remains 0, returning false
@@ -453,22 +1211,168 @@ func compilation_password (s string) (string) {
 	return password
 }
 
-func add_feed_to_catalogue (s string) (bool, int64, error) {
-	// Schema may be omitted by users, so we add http by default
-	// Fetcher will later follow HTTPS redirects, so that's safe
+func http_handler_discover (ctx *fasthttp.RequestCtx) {
+	log_request(ctx)
+	ctx.Response.Header.Set("Content-Type", "application/json")
+
+	target := string(ctx.QueryArgs().Peek("url"))
+	if target == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		response, _ := json.Marshal(map[string]string{"error": "Parameter `url` is missing"})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_discover: %s\n", werr) }
+		return
+	}
+
+	candidates, _, discerr := discover_feeds(target)
+	if discerr != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		if lib.IsBlockedAddress(discerr) { ctx.SetStatusCode(fasthttp.StatusBadRequest) }
+		response, _ := json.Marshal(map[string]string{"error": discerr.Error()})
+		_, werr := ctx.Write(response)
+		if werr != nil { log.Printf("ctx.Write failed in http_handler_discover: %s\n", werr) }
+		return
+	}
+
+	// To get an empty array in JSON
+	if candidates == nil { candidates = []FeedCandidate{} }
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	response, _ := json.Marshal(map[string]interface{}{"url": target, "feeds": candidates})
+	_, werr := ctx.Write(response)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_discover: %s\n", werr) }
+}
+
+func write_candidates (ctx *fasthttp.RequestCtx, ambiguous map[string][]FeedCandidate) {
+	ctx.SetStatusCode(fasthttp.StatusMultipleChoices)
+	response, _ := json.Marshal(map[string]interface{}{"error": "Some URLs link to more than one feed, please choose",
+							   "candidates": ambiguous})
+	_, werr := ctx.Write(response)
+	if werr != nil { log.Printf("ctx.Write failed in write_candidates: %s\n", werr) }
+}
+
+// Returns the catalogue ID for a URL submitted by a user, adding it if necessary.
+// HTML pages are replaced by the feed they link to. If they link to more than
+// one, the candidates are returned instead.
+func catalogue_feed (s string) (int64, []FeedCandidate, error) {
+	exists, feedid := url_in_catalogue(s)
+	if exists { return feedid, nil, nil }
+
+	candidates, ishtml, discerr := discover_feeds(s)
+	if lib.IsBlockedAddress(discerr) { return -1, nil, discerr }
+	if discerr != nil {
+		// Fetcher will find out about any problems later
+		log.Printf("Discovery failed for %s: %s\n", s, discerr)
+	}
+	if ishtml {
+		switch len(candidates) {
+		case 0:
+			return -1, nil, errors.New("No feed found at "+s)
+		case 1:
+			log.Printf("Discovered %s at %s\n", candidates[0].Url, s)
+			s = candidates[0].Url
+			exists, feedid = url_in_catalogue(s)
+			if exists { return feedid, nil, nil }
+		default:
+			return -1, candidates, nil
+		}
+	}
+
+	created, feedid, err := add_feed_to_catalogue(s)
+	if !created {
+		if err == nil { err = errors.New("Could not add "+s+" to catalogue") }
+		return -1, nil, err
+	}
+
+	return feedid, nil, nil
+}
+
+// Retrieves a URL and, if it is an HTML page, returns the feeds it links to.
+// If it is a feed already, that is the only candidate.
+func discover_feeds (s string) ([]FeedCandidate, bool, error) {
 	if strings.ToLower(lib.FirstN(s,4)) != "http" {
 		s = "http://" + s
 	}
 
-	url, err := url.ParseRequestURI(s)
+	client := &http.Client{Timeout: time.Duration(lib.Value_or_default(k.Int("discovery.timeout"), 10).(int)) * time.Second,
+			       Transport: transport}
+	response, geterr := client.Get(s)
+	if geterr != nil { return nil, false, geterr }
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, false, errors.New("Unexpected HTTP status "+response.Status)
+	}
+
+	// Feed links are in the <head>, so we don't need all of it
+	body, readerr := ioutil.ReadAll(io.LimitReader(response.Body, 1048576))
+	if readerr != nil { return nil, false, readerr }
+
+	// Some servers claim feeds to be HTML, so ask gofeed first
+	feedtype := gofeed.DetectFeedType(bytes.NewReader(body))
+	if feedtype != gofeed.FeedTypeUnknown {
+		mimetypes := map[gofeed.FeedType]string{gofeed.FeedTypeRSS: "application/rss+xml",
+							gofeed.FeedTypeAtom: "application/atom+xml",
+							gofeed.FeedTypeJSON: "application/feed+json"}
+		return []FeedCandidate{{Url: s, Type: mimetypes[feedtype]}}, false, nil
+	}
+
+	ctype := response.Header.Get("Content-Type")
+	if ctype == "" { ctype = http.DetectContentType(body) }
+	if !strings.Contains(strings.ToLower(ctype), "html") {
+		return nil, false, nil
+	}
+
+	return html_feed_links(bytes.NewReader(body), response.Request.URL), true, nil
+}
+
+// Collects <link rel="alternate"> elements pointing to feeds
+func html_feed_links (r io.Reader, base *url.URL) ([]FeedCandidate) {
+	var result []FeedCandidate
+	seen := make(map[string]bool)
+	feedtypes := map[string]bool{"application/rss+xml": true,
+				     "application/atom+xml": true,
+				     "application/feed+json": true}
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken { return result }
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken { continue }
+
+		token := tokenizer.Token()
+		if token.Data != "link" { continue }
+
+		attrs := make(map[string]string)
+		for _, attr := range token.Attr {
+			attrs[strings.ToLower(attr.Key)] = strings.TrimSpace(attr.Val)
+		}
+
+		alternate := false
+		for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+			if rel == "alternate" { alternate = true }
+		}
+		ftype := strings.ToLower(attrs["type"])
+		if !alternate || !feedtypes[ftype] || attrs["href"] == "" { continue }
+
+		href, parseerr := base.Parse(attrs["href"])
+		if parseerr != nil || seen[href.String()] { continue }
+		seen[href.String()] = true
+
+		result = append(result, FeedCandidate{Url: href.String(), Type: ftype, Title: attrs["title"]})
+	}
+}
+
+func add_feed_to_catalogue (s string) (bool, int64, error) {
+	schema, urn, err := lib.Normalize_url(s)
 	if err != nil {
 		log.Println(err)
 		return false, -1, err
 	}
 
 	_, dberr := database.Exec("INSERT INTO feed (uschema, urn, created) VALUES (?,?,?)",
-					strings.ToLower(url.Scheme),
-					strings.ToLower(url.Host)+url.Path,
+					schema,
+					urn,
 					time.Now().Unix())
 	if dberr != nil {
 		log.Println(dberr)
@@ -477,7 +1381,7 @@ func add_feed_to_catalogue (s string) (bool, int64, error) {
 
 	exists, feedid := url_in_catalogue(s)
 	if exists {
-		_, dberr := database.Exec("INSERT INTO feed_status VALUES (?,?,?,?)", feedid, 0, 0, 1)
+		_, dberr := database.Exec("INSERT INTO feed_status (id, refreshed, updated, active) VALUES (?,?,?,?)", feedid, 0, 0, 1)
 		if dberr != nil {
 			log.Printf("Feed %d was added but could not be added to feed_status: %s\n", feedid, dberr)
 		}
@@ -486,21 +1390,125 @@ func add_feed_to_catalogue (s string) (bool, int64, error) {
 	return exists, feedid, nil
 }
 
-func url_in_catalogue (s string) (bool, int64) {
-	if strings.ToLower(lib.FirstN(s,4)) != "http" {
-		s = "http://" + s
+// Returns the catalogue ID for a source, adding it if necessary
+func catalogue_source (src lib.Source) (int64, error) {
+	validerr := src.Validate()
+	if validerr != nil { return -1, validerr }
+
+	exists, feedid := source_in_catalogue(src)
+	if exists { return feedid, nil }
+
+	schema, urn, normerr := lib.Normalize_url(src.Url)
+	if normerr != nil { return -1, normerr }
+
+	// Sources are not probed here, so check where they point to
+	parsed, parseerr := url.Parse(schema+"://"+urn)
+	if parseerr != nil { return -1, parseerr }
+	blockerr := guard.Check_host(parsed.Hostname())
+	if blockerr != nil { return -1, blockerr }
+
+	mapping, jmerr := json.Marshal(src.Mapping)
+	if jmerr != nil { return -1, jmerr }
+
+	_, dberr := database.Exec("INSERT INTO feed (uschema, urn, created, source, mapping) VALUES (?,?,?,?,?)",
+					schema, urn, time.Now().Unix(), src.Type, string(mapping))
+	if dberr != nil {
+		log.Println(dberr)
+		return -1, dberr
 	}
 
-	url, err := url.ParseRequestURI(s)
+	exists, feedid = source_in_catalogue(src)
+	if !exists { return -1, errors.New("Could not add "+src.Url+" to catalogue") }
+
+	_, dberr = database.Exec("INSERT INTO feed_status (id, refreshed, updated, active) VALUES (?,?,?,?)", feedid, 0, 0, 1)
+	if dberr != nil {
+		log.Printf("Feed %d was added but could not be added to feed_status: %s\n", feedid, dberr)
+	}
+
+	return feedid, nil
+}
+
+func source_in_catalogue (src lib.Source) (bool, int64) {
+	schema, urn, normerr := lib.Normalize_url(src.Url)
+	if normerr != nil {
+		log.Println(normerr)
+		return false, -1
+	}
+
+	mapping, jmerr := json.Marshal(src.Mapping)
+	if jmerr != nil { return false, -1 }
+
+	var feedid int64
+	scanerr := database.QueryRow("SELECT id FROM feed WHERE uschema = ? AND urn = ? AND source = ? AND mapping = ?",
+					schema, urn, src.Type, string(mapping)).Scan(&feedid)
+	if scanerr == nil { return true, feedid }
+
+	if scanerr != sql.ErrNoRows { log.Println(scanerr) }
+	return false, -1
+}
+
+// Returns the catalogue ID for a feed with credentials, adding it if necessary.
+// Such feeds are catalogued by URL and credentials, so their content is only shared
+// by compilations which know the same credentials, and the credentials of an entry
+// never change. Other credentials for the same URL get an entry of their own.
+func catalogue_private_feed (s string, creds lib.Credentials) (int64, error) {
+	schema, urn, normerr := lib.Normalize_url(s)
+	if normerr != nil { return -1, normerr }
+	credid := lib.Credentials_id(creds, k.String("credentials.key"))
+
+	exists, feedid := private_feed_in_catalogue(schema, urn, credid)
+	if exists { return feedid, nil }
+
+	// Private feeds are not discovered, so check where they point to
+	parsed, parseerr := url.Parse(schema+"://"+urn)
+	if parseerr != nil { return -1, parseerr }
+	blockerr := guard.Check_host(parsed.Hostname())
+	if blockerr != nil { return -1, blockerr }
+
+	encrypted, encerr := lib.Encrypt_credentials(creds, k.String("credentials.key"))
+	if encerr != nil { return -1, encerr }
+
+	_, dberr := database.Exec("INSERT INTO feed (uschema, urn, created, credentials, credentials_id) VALUES (?,?,?,?,?)",
+					schema, urn, time.Now().Unix(), encrypted, credid)
+	if dberr != nil {
+		log.Println(dberr)
+		return -1, dberr
+	}
+
+	exists, feedid = private_feed_in_catalogue(schema, urn, credid)
+	if !exists { return -1, errors.New("Could not add "+s+" to catalogue") }
+
+	_, dberr = database.Exec("INSERT INTO feed_status (id, refreshed, updated, active) VALUES (?,?,?,?)", feedid, 0, 0, 1)
+	if dberr != nil {
+		log.Printf("Feed %d was added but could not be added to feed_status: %s\n", feedid, dberr)
+	}
+
+	return feedid, nil
+}
+
+func private_feed_in_catalogue (schema string, urn string, credid string) (bool, int64) {
+	var feedid int64
+	scanerr := database.QueryRow("SELECT id FROM feed WHERE uschema = ? AND urn = ? AND COALESCE(source,'feed') = 'feed' AND credentials_id = ?",
+					schema, urn, credid).Scan(&feedid)
+	if scanerr == nil { return true, feedid }
+
+	if scanerr != sql.ErrNoRows { log.Println(scanerr) }
+	return false, -1
+}
+
+func url_in_catalogue (s string) (bool, int64) {
+	schema, urn, err := lib.Normalize_url(s)
 	if err != nil {
 		log.Println(err)
 		return false, -1
 	}
 
 	var feedid int64
-	scanerr := database.QueryRow("SELECT id FROM feed WHERE uschema = ? AND urn = ?",
-					strings.ToLower(url.Scheme),
-					strings.ToLower(url.Host)+url.Path).Scan(&feedid)
+	// Feeds with credentials are only found with them, see `catalogue_private_feed`
+	scanerr := database.QueryRow(`SELECT id FROM feed WHERE uschema = ? AND urn = ? AND COALESCE(source,'feed') = 'feed'
+				      AND COALESCE(credentials,'') = '' AND COALESCE(credentials_id,'') = ''`,
+					schema,
+					urn).Scan(&feedid)
 
 	if scanerr == nil {
 		// success
@@ -531,6 +1539,26 @@ func generate_id (length int) (string) {
 	return strings.Join(result, "")
 }
 
+func http_handler_metrics (ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	werr := lib.Write_metrics(ctx)
+	if werr != nil { log.Printf("ctx.Write failed in http_handler_metrics: %s\n", werr) }
+}
+
+// Records requests by the route they matched
+func count_requests (next fasthttp.RequestHandler) (fasthttp.RequestHandler) {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		next(ctx)
+
+		route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+		if route == "" { route = "unknown" }
+		api_requests.Inc(route, string(ctx.Method()), strconv.Itoa(ctx.Response.StatusCode()))
+		api_duration.Observe(time.Since(start).Seconds(), route)
+	}
+}
+
 func http_handler_get_memstats (ctx *fasthttp.RequestCtx) {
 	var memstats runtime.MemStats
 	runtime.ReadMemStats(&memstats)
@@ -553,7 +1581,135 @@ func http_handler_get_version (ctx *fasthttp.RequestCtx) {
 	if werr != nil { log.Printf("ctx.Write failed in http_handler_get_version: %s\n", werr) }
 }
 
-func url_from_id (cplid string) (string) {
+func validate_mirror (m Mirror) (error) {
+	if !m.Enabled { return nil }
+	if !k.Bool("mirror.enabled") { return errors.New("Enclosure mirroring is not supported by this server") }
+	// Database storage keeps whole objects in memory
+	if k.String("storage.type") == "database" { return errors.New("Enclosure mirroring needs filesystem or S3 storage") }
+	if m.Quota < 0 { return errors.New("Mirror quota must not be negative") }
+
+	maxquota := int64(k.Int("mirror.maxquota"))
+	if maxquota > 0 && m.Quota > maxquota {
+		return errors.New("Mirror quota must not exceed "+strconv.FormatInt(maxquota, 10)+" MB")
+	}
+	return nil
+}
+
+func validate_formats (formats []string) (error) {
+	for _, format := range formats {
+		if !lib.Valid_format(format) {
+			return errors.New("Unknown output format "+format+", must be one of "+strings.Join(lib.OutputFormats, ", "))
+		}
+	}
+	return nil
+}
+
+// Podcast channels are only written to RSS
+func validate_podcast_formats (p lib.Podcast, formats []string) (error) {
+	if !p.Enabled { return nil }
+	for _, format := range formats {
+		if format == "rss" { return nil }
+	}
+	return errors.New("Podcast mode needs the rss format")
+}
+
+// Returns the expression as stored in the database, empty if there is none
+func validate_filter (include []string, exclude []string, expression string) (string, error) {
+	for _, patterns := range [][]string{include, exclude} {
+		for _, pattern := range patterns {
+			_, reerr := regexp.Compile(pattern)
+			if reerr != nil { return "", errors.New("Invalid regular expression "+pattern+": "+reerr.Error()) }
+		}
+	}
+
+	if strings.TrimSpace(expression) == "" { return "", nil }
+	expr, parseerr := lib.Parse_filter(expression)
+	if parseerr != nil { return "", parseerr }
+	return expr.Json(), nil
+}
+
+// Returns the expressions as stored in the database by URL, empty ones remove a filter
+func validate_feed_filters (filters map[string]string) (map[string]string, error) {
+	result := make(map[string]string)
+	for url, expression := range filters {
+		stored, filtererr := validate_filter(nil, nil, expression)
+		if filtererr != nil { return nil, errors.New("Filter for "+url+": "+filtererr.Error()) }
+		result[url] = stored
+	}
+	return result, nil
+}
+
+// Returns the feed IDs for filters by URL, which must be added along with
+// them or, if `cplid` is set, already be part of the compilation
+func filter_feed_ids (cplid string, filters map[string]string, added map[string]int64, sources []lib.Source, sourceids []int64) (map[string]int64, error) {
+	result := make(map[string]int64)
+
+	for url := range filters {
+		if feedid, ok := added[url]; ok {
+			result[url] = feedid
+			continue
+		}
+		for i, src := range sources {
+			if src.Url == url && i < len(sourceids) { result[url] = sourceids[i] }
+		}
+		if _, ok := result[url]; ok { continue }
+
+		schema, urn, normerr := lib.Normalize_url(url)
+		if cplid != "" && normerr == nil {
+			var feedid int64
+			scanerr := database.QueryRow(`SELECT feed.id FROM feed
+						      INNER JOIN compilation_content ON compilation_content.feed_id = feed.id
+						      WHERE compilation_content.id = ? AND feed.uschema = ? AND feed.urn = ?`, cplid, schema, urn).Scan(&feedid)
+			if scanerr == nil {
+				result[url] = feedid
+				continue
+			}
+			if scanerr != sql.ErrNoRows { return nil, scanerr }
+		}
+		return nil, errors.New("Filter for "+url+", which is not part of the compilation")
+	}
+
+	return result, nil
+}
+
+// Stores the filter of a feed within a compilation, an empty one removes it
+func set_feed_filter (tx *sql.Tx, cplid string, feedid int64, stored string) (error) {
+	var value interface{}
+	if stored != "" { value = stored }
+	_, execerr := tx.Exec("UPDATE compilation_content SET filter_expr = ? WHERE id = ? AND feed_id = ?", value, cplid, feedid)
+	return execerr
+}
+
+// Returns the rules as stored in the database, NULL if there are none
+func rewrite_column (r lib.Rewrite) (interface{}) {
+	if r.Empty() { return nil }
+	return r.Json()
+}
+
+// Returns the podcast settings as stored in the database, NULL if there are none
+func podcast_column (p lib.Podcast) (interface{}) {
+	if p.Empty() { return nil }
+	return p.Json()
+}
+
+func validate_dedup (d Dedup) (error) {
+	for _, key := range d.Keys {
+		if !lib.Valid_dedup_key(key) {
+			return errors.New("Unknown deduplication key "+key+", must be one of "+strings.Join(lib.DedupKeys, ", "))
+		}
+	}
+	if d.Keep != "" && !lib.Valid_dedup_keep(d.Keep) {
+		return errors.New("Deduplication must keep one of "+strings.Join(lib.DedupKeep, ", "))
+	}
+	return nil
+}
+
+func bool_to_int (b bool) (int) {
+	if b { return 1 }
+	return 0
+}
+
+func url_from_id (cplid string, format string) (string) {
 	var result string
 
 	// Read URL settings from config
@@ -566,13 +1722,29 @@ func url_from_id (cplid string) (string) {
 	if subdirs > 0 {
 		result += lib.Subdirs(cplid, subdirs)
 	}
-	result += "/"+cplid+".rss"
+	result += "/"+cplid+lib.Format_extension(format)
 
 	return result
 }
 
 func log_request (ctx *fasthttp.RequestCtx) {
-	log.Printf("%s %s %s\n", ctx.Method(), ctx.Path(), ctx.PostBody())
+	log.Printf("%s %s %s\n", ctx.Method(), ctx.Path(), redact_credentials(ctx.PostBody()))
+}
+
+// Feed credentials are sent in plain text, but must not end up in the log.
+// JSON keys match case-insensitively, like `json.Unmarshal` does.
+func redact_credentials (body []byte) ([]byte) {
+	if !bytes.Contains(bytes.ToLower(body), []byte("credentials")) && !bytes.Contains(body, []byte(`\u`)) { return body }
+
+	var fields map[string]json.RawMessage
+	jsonerr := json.Unmarshal(body, &fields)
+	if jsonerr != nil { return []byte("<body omitted, may contain credentials>") }
+
+	for key := range fields {
+		if strings.EqualFold(key, "credentials") { fields[key] = json.RawMessage(`"[redacted]"`) }
+	}
+	redacted, _ := json.Marshal(fields)
+	return redacted
 }
 
 func verify_google_captcha (ctx *fasthttp.RequestCtx) (bool) {
@@ -619,6 +1791,10 @@ func verify_google_captcha (ctx *fasthttp.RequestCtx) (bool) {
 	return false
 }
 
-func trim_dotrss (s string) (string) {
-	return strings.TrimSuffix(s, ".rss")
+// IDs may be given with the extension of any output format
+func trim_extension (s string) (string) {
+	for _, format := range lib.OutputFormats {
+		s = strings.TrimSuffix(s, lib.Format_extension(format))
+	}
+	return s
 }
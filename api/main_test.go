@@ -0,0 +1,100 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+import "github.com/jmoiron/sqlx"
+import "github.com/knadh/koanf"
+import "github.com/valyala/fasthttp"
+
+import "github.com/stevemeier/rssmix/lib"
+
+// Points `database` at a new database with the schema in `sql/sqlite3.txt`
+func test_database (t *testing.T) (func ()) {
+	dir, direrr := ioutil.TempDir("", "rssmix")
+	if direrr != nil { t.Fatal(direrr) }
+
+	schema, readerr := ioutil.ReadFile("../sql/sqlite3.txt")
+	if readerr != nil { t.Fatal(readerr) }
+
+	var dberr error
+	database, dberr = sqlx.Open("sqlite3", filepath.Join(dir, "rssmix.sql"))
+	if dberr != nil { t.Fatal(dberr) }
+	database.SetMaxOpenConns(1)
+	database.MustExec(string(schema))
+
+	var guarderr error
+	guard, guarderr = lib.NewAddressGuard(koanf.New("."))
+	if guarderr != nil { t.Fatal(guarderr) }
+
+	return func () {
+		database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCatalogueSourceQuery (t *testing.T) {
+	defer test_database(t)()
+
+	// An IP address, so nothing needs to be resolved
+	src := lib.Source{Url: "https://93.184.216.34/api/issues?status=open&limit=50",
+			  Type: "json",
+			  Mapping: lib.SourceMapping{Items: "$.issues[*]", Title: "$.title", Link: "$.url"}}
+	feedid, caterr := catalogue_source(src)
+	if caterr != nil { t.Fatal(caterr) }
+
+	// fetcher requests `uschema://urn`
+	var schema string
+	var urn string
+	scanerr := database.QueryRow("SELECT uschema, urn FROM feed WHERE id = ?", feedid).Scan(&schema, &urn)
+	if scanerr != nil { t.Fatal(scanerr) }
+	if schema+"://"+urn != src.Url { t.Errorf("Source is fetched from %s://%s, want %s", schema, urn, src.Url) }
+
+	again, caterr := catalogue_source(src)
+	if caterr != nil || again != feedid { t.Errorf("Same source catalogued as %d (%v), want %d", again, caterr, feedid) }
+
+	// Another page is another document
+	src.Url = "https://93.184.216.34/api/issues?status=open&limit=50&page=2"
+	other, caterr := catalogue_source(src)
+	if caterr != nil || other == feedid { t.Errorf("Next page catalogued as %d (%v), the first page is %d", other, caterr, feedid) }
+}
+
+func TestCatalogueHtmlSourceQuery (t *testing.T) {
+	defer test_database(t)()
+
+	src := lib.Source{Url: "https://93.184.216.34/search?tag=go&page=2",
+			  Type: "html",
+			  Mapping: lib.SourceMapping{Items: "article", Title: "h2", Link: "a@href", Summary: "img@alt"}}
+	feedid, caterr := catalogue_source(src)
+	if caterr != nil { t.Fatal(caterr) }
+
+	var schema string
+	var urn string
+	scanerr := database.QueryRow("SELECT uschema, urn FROM feed WHERE id = ?", feedid).Scan(&schema, &urn)
+	if scanerr != nil { t.Fatal(scanerr) }
+	if schema+"://"+urn != src.Url { t.Errorf("Source is fetched from %s://%s, want %s", schema, urn, src.Url) }
+}
+
+func TestRefreshCompilationWithoutStatus (t *testing.T) {
+	defer test_database(t)()
+
+	// Never compiled, so there is no compilation_status row
+	database.MustExec("INSERT INTO compilation (id, name) VALUES ('a', 'A')")
+
+	refresh := func () (int) {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.SetUserValue("id", "a")
+		http_handler_refresh_compilation(&ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	if status := refresh(); status != fasthttp.StatusAccepted { t.Errorf("First refresh returned %d, want %d", status, fasthttp.StatusAccepted) }
+	if status := refresh(); status != fasthttp.StatusTooManyRequests { t.Errorf("Second refresh returned %d, want %d", status, fasthttp.StatusTooManyRequests) }
+
+	var requested int64
+	scanerr := database.QueryRow("SELECT refresh_requested FROM compilation_status WHERE id = 'a'").Scan(&requested)
+	if scanerr != nil || requested == 0 { t.Errorf("Refresh was not requested: %v", scanerr) }
+}
@@ -1,14 +1,19 @@
 package main
 
+import "errors"
+import "io/ioutil"
 import "log"
 import "os"
+import "path/filepath"
 import "regexp"
 import "sort"
+import "strconv"
 import "strings"
 import "time"
 
 import "github.com/mmcdole/gofeed"
-import "github.com/gorilla/feeds"
+import "github.com/mmcdole/gofeed/atom"
+import "github.com/mmcdole/gofeed/rss"
 
 // SQL modules
 import _ "github.com/mattn/go-sqlite3"
@@ -19,10 +24,52 @@ import "github.com/knadh/koanf"
 
 import "github.com/stevemeier/rssmix/lib"
 
+// A feed of a compilation, with its own filter if it has one
+type ContentFeed struct {
+	Url		string
+	Filename	string
+	Filter		*lib.FilterExpr
+}
+
+// Title and website of the feed an item came from
+type SourceFeed struct {
+	Title		string
+	Link		string
+}
+
+// Keep what the universal gofeed.Item has no field for in `Custom`
+type rss_translator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+type atom_translator struct {
+	gofeed.DefaultAtomTranslator
+}
+
+type MirroredEnclosure struct {
+	Url		string
+	Size		int64
+}
+
+// Failed rebuilds of a compilation refreshed via `api`, for the refresh requested at `Requested`
+type RefreshFailure struct {
+	Requested	int64
+	Attempts	int
+	Last		time.Time
+}
+
 // Global variables
 var version string
 var database *sqlx.DB
+var storage lib.Storage
 var k = koanf.New(".")
+var refresh_failures = make(map[string]RefreshFailure)
+
+// Metrics
+var compilations_built = lib.NewCounter("rssmix_compilations_built_total", "Compilations built by result", "result")
+var compile_duration = lib.NewHistogram("rssmix_compile_duration_seconds", "Time taken to build a compilation", lib.LatencyBuckets)
+var duplicates_removed = lib.NewCounter("rssmix_duplicates_removed_total", "Items dropped as duplicates of items in other feeds")
+var compilation_items = lib.NewHistogram("rssmix_compilation_items", "Number of items per compilation built", []float64{10, 25, 50, 100, 250, 500, 1000, 2500})
 
 func main() {
 	log.Printf("Version: %s\n", version)
@@ -38,7 +85,22 @@ func main() {
 	if dberr != nil { log.Fatal(dberr) }
 	defer database.Close()
 
+	// Feed storage, as written by fetcher
+	var storeerr error
+	storage, storeerr = lib.OpenStorage(k, database)
+	if storeerr != nil { log.Fatal(storeerr) }
+
+	lib.Serve_metrics(lib.Value_or_default(k.String("metrics.listen"), "127.0.0.1:9812").(string))
+
+	var lastgc time.Time
 	for {
+		// Housekeeping, if enabled
+		gcinterval := time.Duration(k.Int("gc.interval")) * time.Minute
+		if gcinterval > 0 && time.Since(lastgc) >= gcinterval {
+			collect_garbage()
+			lastgc = time.Now()
+		}
+
 		queue := compilations_needing_update()
 
 		if len(queue) == 0 {
@@ -46,16 +108,56 @@ func main() {
 		}
 
 		for _, cplid := range queue {
+			start := time.Now()
 			updsuccess, _ := update_compilation(cplid)
+			compile_duration.Observe(time.Since(start).Seconds())
 			if updsuccess {
+				compilations_built.Inc("success")
+				delete(refresh_failures, cplid)
 				updok, upderr := mark_compilation_updated(cplid)
 				if !updok {
 					log.Printf("[%s] Database error: %s\n", cplid, upderr)
 				}
+			} else {
+				compilations_built.Inc("failure")
+				record_refresh_failure(cplid)
 			}
 		}
 
-		time.Sleep(60 * time.Second)
+		wait_for_cycle(60 * time.Second)
+	}
+}
+
+func collect_garbage () {
+	configerr := lib.Check_gc_config(k)
+	if configerr != nil {
+		log.Printf("Garbage collection skipped: %s\n", configerr)
+		return
+	}
+
+	minage := time.Duration(lib.Value_or_default(k.Int("gc.minage"), 60).(int)) * time.Minute
+	report, gcerr := lib.Collect_garbage(database, storage, minage, false)
+	if gcerr != nil {
+		log.Printf("Garbage collection failed: %s\n", gcerr)
+		return
+	}
+
+	log.Printf("Garbage collection removed %d feed_status rows, %d websub rows, %d compilation_status rows, %d files, %d outputs (%d bytes)\n",
+		   report.FeedStatus, report.Websub, report.CplStatus, len(report.Files), len(report.Outputs), report.Bytes)
+	for _, gcerr := range report.Errors {
+		log.Printf("Garbage collection error: %s\n", gcerr)
+	}
+}
+
+// Sleeps until the next cycle, unless a compilation was refreshed via `api`
+func wait_for_cycle (d time.Duration) {
+	poll := refresh_poll()
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		step := time.Until(deadline)
+		if step > poll { step = poll }
+		time.Sleep(step)
+		if len(compilations_refreshed()) > 0 { return }
 	}
 }
 
@@ -63,6 +165,8 @@ func update_compilation (cplid string) (bool, error) {
 	log.Printf("[%s] Updating compilation\n", cplid)
 
 	fp := gofeed.NewParser()
+	fp.RSSTranslator = &rss_translator{}
+	fp.AtomTranslator = &atom_translator{}
 
 	// Get feed parameters from DB
 	var title string
@@ -72,7 +176,20 @@ func update_compilation (cplid string) (bool, error) {
 	var db_filter_exc string
 	var filter_inc []*regexp.Regexp
 	var filter_exc []*regexp.Regexp
-	qrerr := database.QueryRow("SELECT name, COALESCE(filename,''), COALESCE(url,''), COALESCE(filter_inc,''), COALESCE(filter_exc,'') FROM compilation WHERE id = ?", cplid).Scan(&title, &outfile, &publicurl, &db_filter_inc, &db_filter_exc)
+	var db_filter_expr string
+	var filter_expr *lib.FilterExpr
+	var mirror int64
+	var formats string
+	var dedup string
+	var dedup_keep string
+	var db_rewrite string
+	var rewrite *lib.Rewrite
+	var db_podcast string
+	var podcast *lib.Podcast
+	qrerr := database.QueryRow(`SELECT name, COALESCE(filename,''), COALESCE(url,''), COALESCE(filter_inc,''), COALESCE(filter_exc,''), COALESCE(mirror,0),
+				    COALESCE(formats,''), COALESCE(dedup,''), COALESCE(dedup_keep,''), COALESCE(filter_expr,''),
+				    COALESCE(rewrite,''), COALESCE(podcast,'') FROM compilation WHERE id = ?`, cplid).Scan(&title, &outfile, &publicurl, &db_filter_inc, &db_filter_exc, &mirror,
+																	     &formats, &dedup, &dedup_keep, &db_filter_expr, &db_rewrite, &db_podcast)
 	if qrerr != nil {
 		log.Println(qrerr)
 		return false, qrerr
@@ -80,91 +197,201 @@ func update_compilation (cplid string) (bool, error) {
 
 	if outfile == "" {
 		log.Printf("[%s] No output filename set. Skipping!\n", cplid)
+		return false, errors.New("No output filename set")
 	}
 
 	// We turn the string from the database into an array of regexp
-	if len(db_filter_inc) > 0 { filter_inc = string_to_regexp(db_filter_inc, ",") }
-	if len(db_filter_exc) > 0 { filter_exc = string_to_regexp(db_filter_exc, ",") }
+	if len(db_filter_inc) > 0 { filter_inc = string_to_regexp(db_filter_inc) }
+	if len(db_filter_exc) > 0 { filter_exc = string_to_regexp(db_filter_exc) }
+	if len(db_filter_expr) > 0 {
+		var filtererr error
+		filter_expr, filtererr = lib.Load_filter(db_filter_expr)
+		if filtererr != nil {
+			// Better no output than one with unwanted items
+			log.Printf("[%s] Invalid filter expression: %s\n", cplid, filtererr)
+			return false, filtererr
+		}
+	}
+
+	if len(db_rewrite) > 0 {
+		var rewriteerr error
+		rewrite, rewriteerr = lib.Load_rewrite(db_rewrite)
+		if rewriteerr != nil {
+			log.Printf("[%s] Invalid rewrite rules: %s\n", cplid, rewriteerr)
+			return false, rewriteerr
+		}
+	}
+
+	if len(db_podcast) > 0 {
+		var podcasterr error
+		podcast, podcasterr = lib.Load_podcast(db_podcast)
+		if podcasterr != nil {
+			log.Printf("[%s] Invalid podcast settings: %s\n", cplid, podcasterr)
+			return false, podcasterr
+		}
+		if !podcast.Enabled { podcast = nil }
+	}
+
+	// Enclosures mirrored by fetcher
+	mirrored := make(map[string]MirroredEnclosure)
+	if mirror > 0 { mirrored = mirrored_enclosures(cplid) }
 
 	// Create feed object
-	output := &feeds.Feed{}
+	output := &lib.CompiledFeed{}
 	output.Title = title
 	output.Created = time.Now()
-	output.Link = &feeds.Link{Href: publicurl} // this is required
+	output.Link = publicurl
+	output.Podcast = podcast
+
+	sources := make(map[*lib.CompiledItem]SourceFeed)
 
-	var files []string
-	rows, ferr := database.Query(`SELECT feed.filename FROM feed
+	var files []ContentFeed
+	rows, ferr := database.Query(`SELECT feed.uschema, feed.urn, COALESCE(feed.filename,''), COALESCE(compilation_content.filter_expr,'') FROM feed
 				      INNER JOIN compilation_content ON compilation_content.feed_id = feed.id
 				      WHERE compilation_content.id = ?`, cplid)
 	if ferr != nil {
 		log.Println(ferr)
 		return false, ferr
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var nextfile string
-		scanerr := rows.Scan(&nextfile)
+		var nextfile ContentFeed
+		var schema string
+		var urn string
+		var feedfilter string
+		scanerr := rows.Scan(&schema, &urn, &nextfile.Filename, &feedfilter)
 		if scanerr != nil {
 			log.Println(scanerr)
 			return false, scanerr
 		}
+		nextfile.Url = schema+"://"+urn
+
+		if feedfilter != "" {
+			var filtererr error
+			nextfile.Filter, filtererr = lib.Load_filter(feedfilter)
+			if filtererr != nil {
+				log.Printf("[%s] Invalid filter expression for %s: %s\n", cplid, nextfile.Filename, filtererr)
+				return false, filtererr
+			}
+		}
 
-		if nextfile != "" {
+		if nextfile.Filename != "" {
 			files = append(files, nextfile)
 		}
 	}
 
-	for _, file := range files {
+	for _, feed := range files {
+		file := feed.Filename
 		log.Printf("[%s] Parsing %s\n", cplid, file)
-		reader, openerr := os.Open(file)
+		reader, openerr := storage.Get(file)
+		if openerr != nil {
+			log.Printf("[%s] Could not read %s: %s\n", cplid, file, openerr)
+			continue
+		}
 		input, parseerr := fp.Parse(reader)
-		if openerr != nil || parseerr != nil { continue }
+		reader.Close()
+		if parseerr != nil { continue }
 
 	        for _, item := range input.Items {
-			nextitem := transform_item(item)
-			// Apply filter
-			if (len(filter_inc) == 0 && len(filter_exc) == 0) ||
-			   (len(filter_inc) > 0 &&  match_any(nextitem.Title, filter_inc)) ||
-			   (len(filter_exc) > 0 && !match_any(nextitem.Title, filter_exc)) {
-				// Neither include nor exlcude is set
-				// Include is set and matches
-				// Exclude is set and does not match
-				output.Items = append(output.Items, &nextitem)
+			nextitem := transform_item(item, mirrored)
+			// Items taken from another feed keep their source
+			if nextitem.Origin.Url == "" { nextitem.Origin = lib.ItemOrigin{Title: input.Title, Url: feed.Url} }
+			// Apply filters, an item must pass all of them
+			if (len(filter_inc) == 0 || match_any(nextitem.Title, filter_inc)) &&
+			   (len(filter_exc) == 0 || !match_any(nextitem.Title, filter_exc)) &&
+			   (filter_expr == nil || filter_expr.Match(item)) &&
+			   (feed.Filter == nil || feed.Filter.Match(item)) {
+				output.Items = append(output.Items, nextitem)
+				sources[nextitem] = SourceFeed{Title: input.Title, Link: input.Link}
 			} else {
 				log.Printf("Not adding %s\n", nextitem.Title)
 			}
 		}
 	}
 
+	// The same story may be carried by several feeds
+	if keys := lib.Parse_dedup(dedup); len(keys) > 0 {
+		before := len(output.Items)
+		output.Items = deduplicate(output.Items, keys, dedup_keep)
+		if len(output.Items) < before {
+			log.Printf("[%s] Removed %d duplicate items\n", cplid, before - len(output.Items))
+			duplicates_removed.Add(float64(before - len(output.Items)))
+		}
+	}
+
+	// Rewrites come last, so filters and deduplication see the original items
+	if rewrite != nil {
+		for _, item := range output.Items {
+			rewrite.Apply(item, sources[item].Title, sources[item].Link)
+		}
+	}
+
+	// Podcast apps have no use for items without an episode
+	if podcast != nil {
+		var episodes []*lib.CompiledItem
+		for _, item := range output.Items {
+			if len(item.Enclosures) > 0 { episodes = append(episodes, item) }
+		}
+		output.Items = episodes
+	}
+
 	// Sort by time
 	sort.Slice(output.Items, func(i, j int) bool { return (output.Items[i].Created).After((output.Items[j].Created)) })
 
 	// Limit to most recent
-	if k.Int("items.max") > 0 {
+	if k.Int("items.max") > 0 && len(output.Items) > k.Int("items.max") {
 		output.Items = output.Items[:k.Int("items.max")]
 	}
 
-	// Output
-	log.Printf("[%s] Writing to %s\n", cplid, outfile)
-	ofh, oferr := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE, 0644)
-	if oferr != nil {
-		log.Println(oferr)
-		return false, oferr
+	compilation_items.Observe(float64(len(output.Items)))
+
+	// Output, one file per format
+	for _, format := range lib.Parse_formats(formats) {
+		file := lib.Format_path(outfile, format)
+		log.Printf("[%s] Writing %s to %s\n", cplid, format, file)
+		werr := write_output(output, format, file, lib.Format_path(publicurl, format))
+		if werr != nil {
+			log.Println(werr)
+			return false, werr
+		}
 	}
-	defer ofh.Close()
 
-	werr := output.WriteRss(ofh)
-	if werr != nil { log.Println(werr) }
+	return true, nil
+}
+
+// Writes to a temporary file first, so publisher never sees a partial output
+func write_output (output *lib.CompiledFeed, format string, outfile string, feedurl string) (error) {
+	tmpfile, tmperr := ioutil.TempFile(filepath.Dir(outfile), "."+filepath.Base(outfile)+".*")
+	if tmperr != nil { return tmperr }
+	defer os.Remove(tmpfile.Name())
+
+	var werr error
+	switch format {
+	case "atom":
+		werr = lib.Write_atom(tmpfile, output, feedurl)
+	case "json":
+		werr = lib.Write_jsonfeed(tmpfile, output, feedurl)
+	default:
+		werr = lib.Write_rss(tmpfile, output, feedurl)
+	}
+	closeerr := tmpfile.Close()
+	if werr != nil { return werr }
+	if closeerr != nil { return closeerr }
 
-	return werr == nil, werr
+	chmoderr := os.Chmod(tmpfile.Name(), 0644)
+	if chmoderr != nil { return chmoderr }
+	return os.Rename(tmpfile.Name(), outfile)
 }
 
-func transform_item (in *gofeed.Item) (feeds.Item) {
-	// In the initial object, we only set "safe" strings
-	out := feeds.Item{Title: in.Title,
-                          Description: in.Description,
-		          Id: in.GUID,
-		          Content: in.Content}
+func transform_item (in *gofeed.Item, mirrored map[string]MirroredEnclosure) (*lib.CompiledItem) {
+	out := &lib.CompiledItem{Title: in.Title,
+				 Description: in.Description,
+				 Id: in.GUID,
+				 Content: in.Content,
+				 Link: in.Link,
+				 Categories: in.Categories,
+				 ITunes: in.ITunesExt}
 
 	// Updated field is not always set
 	updated := in.UpdatedParsed
@@ -174,30 +401,171 @@ func transform_item (in *gofeed.Item) (feeds.Item) {
 	pubdate := in.PublishedParsed
 	if pubdate != nil { out.Created = *pubdate }
 
-	// Author
-	if len(in.Authors) >= 1 {
-		author := &feeds.Author{Name: in.Authors[0].Name,
-				        Email: in.Authors[0].Email}
-		out.Author = author
-	}
-
-	// Link
-	if len(in.Link) > 0 {
-		out.Link = &feeds.Link{Href: in.Link}
+	// gofeed falls back to dc:creator if there is no author
+	for _, author := range in.Authors {
+		if author != nil { out.Authors = append(out.Authors, lib.ItemAuthor{Name: author.Name, Email: author.Email}) }
 	}
 
 	// Podcasts have enclosures, but not all feeds
-	if len(in.Enclosures) >= 1 {
-		encl := &feeds.Enclosure{Url: in.Enclosures[0].URL,
-				       Length: in.Enclosures[0].Length,
-				       Type: in.Enclosures[0].Type }
+	originals := make(map[string]bool)
+	for _, enclosure := range in.Enclosures {
+		if enclosure == nil || enclosure.URL == "" { continue }
+		originals[enclosure.URL] = true
+		length, _ := strconv.ParseInt(enclosure.Length, 10, 64)
+		encl := lib.ItemEnclosure{Url: enclosure.URL, Type: enclosure.Type, Length: length}
+
+		// Point to our own copy, if we have one
+		if local, ok := mirrored[encl.Url]; ok {
+			encl.Url = local.Url
+			encl.Length = local.Size
+		}
 
-		out.Enclosure = encl
+		out.Enclosures = append(out.Enclosures, encl)
 	}
 
+	// Media RSS, including media:group, unless it repeats an enclosure
+	media := in.Extensions["media"]
+	contents := media["content"]
+	thumbnails := media["thumbnail"]
+	for _, group := range media["group"] {
+		contents = append(contents, group.Children["content"]...)
+		thumbnails = append(thumbnails, group.Children["thumbnail"]...)
+	}
+	for _, content := range contents {
+		url := content.Attrs["url"]
+		if url == "" || originals[url] { continue }
+		out.Media = append(out.Media, lib.ItemMedia{Url: url,
+							   Type: content.Attrs["type"],
+							   Medium: content.Attrs["medium"],
+							   Width: content.Attrs["width"],
+							   Height: content.Attrs["height"]})
+	}
+	if len(thumbnails) > 0 { out.Thumbnail = thumbnails[0].Attrs["url"] }
+	if out.Thumbnail == "" && in.Image != nil { out.Thumbnail = in.Image.URL }
+
+	// Set by our translators
+	out.Comments = in.Custom["comments"]
+	out.Origin = lib.ItemOrigin{Title: in.Custom["source_title"], Url: in.Custom["source_url"]}
+
 	return out
 }
 
+func (t *rss_translator) Translate (feed interface{}) (*gofeed.Feed, error) {
+	result, translateerr := t.DefaultRSSTranslator.Translate(feed)
+	if translateerr != nil { return result, translateerr }
+
+	// Items are translated in order
+	rssfeed := feed.(*rss.Feed)
+	for i, item := range rssfeed.Items {
+		if i >= len(result.Items) { break }
+		set_custom(result.Items[i], "comments", item.Comments)
+		if item.Source != nil {
+			set_custom(result.Items[i], "source_title", item.Source.Title)
+			set_custom(result.Items[i], "source_url", item.Source.URL)
+		}
+	}
+
+	return result, nil
+}
+
+func (t *atom_translator) Translate (feed interface{}) (*gofeed.Feed, error) {
+	result, translateerr := t.DefaultAtomTranslator.Translate(feed)
+	if translateerr != nil { return result, translateerr }
+
+	atomfeed := feed.(*atom.Feed)
+	for i, entry := range atomfeed.Entries {
+		if i >= len(result.Items) { break }
+		for _, link := range entry.Links {
+			if link.Rel == "replies" { set_custom(result.Items[i], "comments", link.Href) }
+		}
+		if entry.Source != nil {
+			set_custom(result.Items[i], "source_title", entry.Source.Title)
+			for _, link := range entry.Source.Links {
+				if link.Rel == "self" { set_custom(result.Items[i], "source_url", link.Href) }
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func set_custom (item *gofeed.Item, key string, value string) {
+	if value == "" { return }
+	if item.Custom == nil { item.Custom = make(map[string]string) }
+	item.Custom[key] = value
+}
+
+// Keeps one item per GUID, canonical link and/or normalized title, depending on `keys`.
+// With `keep` "newest" the most recent of the duplicates wins, otherwise the oldest.
+func deduplicate (items []*lib.CompiledItem, keys []string, keep string) ([]*lib.CompiledItem) {
+	candidates := make([]*lib.CompiledItem, len(items))
+	copy(candidates, items)
+	// Items without a date are never preferred
+	sort.SliceStable(candidates, func(i, j int) (bool) {
+		a, b := candidates[i].Created, candidates[j].Created
+		if a.IsZero() || b.IsZero() { return !a.IsZero() && b.IsZero() }
+		if keep == "newest" { return a.After(b) }
+		return a.Before(b)
+	})
+
+	var result []*lib.CompiledItem
+	seen := make(map[string]bool)
+	for _, item := range candidates {
+		var itemkeys []string
+		for _, key := range keys {
+			switch key {
+			case "guid":
+				if item.Id != "" { itemkeys = append(itemkeys, "guid:"+item.Id) }
+			case "link":
+				if item.Link != "" { itemkeys = append(itemkeys, "link:"+lib.Canonical_link(item.Link)) }
+			case "title":
+				if title := lib.Normalize_title(item.Title); title != "" { itemkeys = append(itemkeys, "title:"+title) }
+			}
+		}
+
+		duplicate := false
+		for _, itemkey := range itemkeys {
+			if seen[itemkey] { duplicate = true }
+			seen[itemkey] = true
+		}
+		if !duplicate { result = append(result, item) }
+	}
+
+	return result
+}
+
+// Returns the public location of mirrored enclosures by their original URL
+func mirrored_enclosures (cplid string) (map[string]MirroredEnclosure) {
+	result := make(map[string]MirroredEnclosure)
+
+	baseurl := strings.TrimSuffix(k.String("mirror.baseurl"), "/")
+	if baseurl == "" {
+		log.Printf("[%s] Compilation mirrors enclosures, but `mirror.baseurl` is not set\n", cplid)
+		return result
+	}
+
+	rows, qerr := database.Query(`SELECT enclosure.url, enclosure.filename, enclosure.size FROM enclosure
+				      INNER JOIN compilation_content ON compilation_content.feed_id = enclosure.feed_id
+				      WHERE compilation_content.id = ? AND COALESCE(enclosure.filename,'') <> ''`, cplid)
+	if qerr != nil {
+		log.Printf("[%s] Database error: %s\n", cplid, qerr)
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var original string
+		var file string
+		var local MirroredEnclosure
+		scanerr := rows.Scan(&original, &file, &local.Size)
+		if scanerr != nil { continue }
+		local.Url = baseurl+"/"+file
+		result[original] = local
+	}
+
+	return result
+}
+
 func compilations_needing_update () ([]string) {
 	var result []string
 
@@ -220,18 +588,84 @@ func compilations_needing_update () ([]string) {
 		result = append(result, cplid)
 	}
 
+	// Refreshed compilations are rebuilt even if none of their feeds changed
+	for _, cplid := range compilations_refreshed() {
+		if !contains(result, cplid) { result = append(result, cplid) }
+	}
+
+	return result
+}
+
+// Returns compilations with a refresh requested, once fetcher has
+// processed all of their queued feeds
+func compilations_refreshed () ([]string) {
+	var result []string
+
+	rows, qerr := database.Query(`SELECT compilation_status.id, COALESCE(compilation_status.refresh_requested,0) FROM compilation_status
+				      WHERE COALESCE(compilation_status.refresh_requested,0) > COALESCE(compilation_status.updated,0)
+				      AND NOT EXISTS (SELECT 1 FROM compilation_content
+						      INNER JOIN feed_status ON feed_status.id = compilation_content.feed_id
+						      WHERE compilation_content.id = compilation_status.id
+						      AND COALESCE(feed_status.refresh_requested,0) > 0
+						      AND COALESCE(feed_status.retry_after,0) <= ?)`, time.Now().Unix())
+	if qerr != nil {
+		log.Println(qerr)
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cplid string
+		var requested int64
+		scanerr := rows.Scan(&cplid, &requested)
+		if scanerr != nil { log.Println(scanerr) }
+
+		// Rebuilds which failed are retried with a growing delay, and only a few times
+		if failure, ok := refresh_failures[cplid]; ok && failure.Requested == requested {
+			if failure.Attempts >= k.Int("refresh.attempts") { continue }
+			if time.Since(failure.Last) < refresh_poll() << uint(failure.Attempts) { continue }
+		}
+
+		result = append(result, cplid)
+	}
+
 	return result
 }
 
+// Counts a failed rebuild against the refresh requested via `api`, if there is one
+func record_refresh_failure (cplid string) {
+	var requested int64
+	var updated int64
+	scanerr := database.QueryRow("SELECT COALESCE(refresh_requested,0), COALESCE(updated,0) FROM compilation_status WHERE id = ?", cplid).Scan(&requested, &updated)
+	if scanerr != nil || requested <= updated { return }
+
+	failure := refresh_failures[cplid]
+	// A new request starts over
+	if failure.Requested != requested { failure = RefreshFailure{Requested: requested} }
+	failure.Attempts++
+	failure.Last = time.Now()
+	refresh_failures[cplid] = failure
+
+	if failure.Attempts >= k.Int("refresh.attempts") {
+		log.Printf("[%s] Refresh failed %d times, giving up until it is requested again\n", cplid, failure.Attempts)
+	} else {
+		log.Printf("[%s] Refresh failed, retrying in %s\n", cplid, refresh_poll() << uint(failure.Attempts))
+	}
+}
+
+func refresh_poll () (time.Duration) {
+	return time.Duration(lib.Value_or_default(k.Int("refresh.poll"), 10).(int)) * time.Second
+}
+
 func mark_compilation_updated (cplid string) (bool, error) {
 	_, dberr := database.Exec("UPDATE compilation_status SET updated = ? WHERE id = ?", time.Now().Unix(), cplid)
 	return dberr == nil, dberr
 }
 
-func string_to_regexp (s string, sep string) ([]*regexp.Regexp) {
+func string_to_regexp (s string) ([]*regexp.Regexp) {
 	var result []*regexp.Regexp
 
-	for _, i := range strings.Split(s, sep) {
+	for _, i := range lib.Split_patterns(s) {
 		re, err := regexp.Compile(i)
 		if err == nil { result = append(result, re) }
 	}
@@ -248,3 +682,11 @@ func match_any (s string, re []*regexp.Regexp) (bool) {
 
 	return false
 }
+
+func contains (list []string, s string) (bool) {
+	for _, item := range list {
+		if item == s { return true }
+	}
+
+	return false
+}
@@ -1,15 +1,32 @@
 package main
 
+import "bytes"
+import "crypto/rand"
 import "crypto/sha256"
 import "crypto/tls"
+import "database/sql"
+import "encoding/json"
 import "fmt"
 import "io"
+import "io/ioutil"
 import "log"
+import mrand "math/rand"
 import "net/http"
+import "net/url"
 import "os"
+import "path/filepath"
+import "regexp"
+import "sort"
 import "strconv"
+import "strings"
+import "sync"
 import "time"
 
+// Feed parsing
+import "github.com/mmcdole/gofeed"
+import "github.com/mmcdole/gofeed/atom"
+import "github.com/mmcdole/gofeed/rss"
+
 // SQL modules
 import _ "github.com/mattn/go-sqlite3"
 import "github.com/jmoiron/sqlx"
@@ -25,8 +42,17 @@ import "github.com/stevemeier/rssmix/lib"
 // Global variables
 var version string
 var database *sqlx.DB
+var storage lib.Storage
+var transport *http.Transport
 var k = koanf.New(".")
 
+// Metrics
+var fetch_attempts = lib.NewCounter("rssmix_fetch_attempts_total", "Feed fetch attempts by result and HTTP status", "result", "status")
+var fetch_bytes = lib.NewCounter("rssmix_fetch_bytes_total", "Bytes of feeds downloaded and stored")
+var fetch_duration = lib.NewHistogram("rssmix_fetch_duration_seconds", "Time taken to fetch a feed, including the download", lib.LatencyBuckets)
+var enclosure_bytes = lib.NewCounter("rssmix_enclosure_bytes_total", "Bytes of enclosures mirrored")
+var cycle_duration = lib.NewGauge("rssmix_fetch_cycle_duration_seconds", "Time taken by the last fetch cycle")
+
 type FeedStatus struct {
 	Id		int64
 	Schema		string
@@ -36,7 +62,33 @@ type FeedStatus struct {
 	URL		string
 	URLHash		string
 	File		string
-	Download	bool
+	ETag		string
+	LastModified	string
+	Interval	int64
+	Deactivated	int64
+	Source		string
+	Mapping		string
+	CredentialsId	string
+}
+
+// Scheduling hints found in a downloaded feed
+type FeedHints struct {
+	ItemGap		time.Duration
+	Silence		time.Duration
+	TTL		time.Duration
+	UpdatePeriod	time.Duration
+	SkipHours	map[int]bool
+	SkipDays	map[time.Weekday]bool
+	Pushed		bool
+}
+
+// Limits concurrent requests and enforces a minimum delay per host
+type HostLimiter struct {
+	mutex		sync.Mutex
+	slots		map[string]chan struct{}
+	last		map[string]time.Time
+	concurrency	int
+	delay		time.Duration
 }
 
 func main () {
@@ -49,13 +101,17 @@ func main () {
 	// Set TLS verification flag
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: k.Bool("tls.insecure")}
 
+	// Feed URLs come from users, so keep them away from internal addresses
+	guard, guarderr := lib.NewAddressGuard(k)
+	if guarderr != nil { log.Fatal(guarderr) }
+	transport = guard.Transport()
+
+	// Used to spread out retries
+	mrand.Seed(time.Now().UnixNano())
+
 	// Refresh interval
 	interval := time.Duration(k.Int("interval")) * time.Minute
 
-	// Output directory
-	storedir := k.String("workdir")
-	log.Printf("Storing data in %s\n", storedir)
-
 	// Open database
 	log.Printf("Opening database: %s\n", k.String("database.url"))
         var dberr error
@@ -63,21 +119,58 @@ func main () {
         if dberr != nil { log.Fatal(dberr) }
 	defer database.Close()
 
+	// SQLite does not cope well with concurrent writers
+	if k.String("database.type") == "sqlite3" { database.SetMaxOpenConns(1) }
+
+	lib.Serve_metrics(lib.Value_or_default(k.String("metrics.listen"), "127.0.0.1:9811").(string))
+
+	// Open feed storage
+	var storeerr error
+	storage, storeerr = lib.OpenStorage(k, database)
+	if storeerr != nil { log.Fatal(storeerr) }
+	log.Printf("Storing feeds in %s storage\n", lib.Value_or_default(k.String("storage.type"), "filesystem"))
+
+	log.Printf("Using %d workers, %d connection(s) and %dms delay per host\n", k.Int("workers"), k.Int("host.concurrency"), k.Int("host.delay"))
+
 	for {
 		// We enter an endless loop here
 		start := time.Now()
-		refresh_feeds(storedir)
+		refresh_feeds(false)
 		end := time.Now()
-		time.Sleep(interval - (end.Sub(start)))
+
+		duration := end.Sub(start)
+		log.Printf("Cycle finished in %s\n", duration)
+		cycle_duration.Set(duration.Seconds())
+		if duration > interval {
+			log.Printf("Cycle took longer than interval (%s), consider raising `workers`\n", interval)
+		}
+		wait_for_cycle(interval - duration)
 	}
 }
 
+// Sleeps until the next cycle, but fetches feeds queued for refresh in the meantime
+func wait_for_cycle (d time.Duration) {
+	poll := time.Duration(lib.Value_or_default(k.Int("refresh.poll"), 10).(int)) * time.Second
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		step := time.Until(deadline)
+		if step > poll { step = poll }
+		time.Sleep(step)
+		refresh_feeds(true)
+	}
+}
 
-func refresh_feeds (storedir string) {
-	var scanerr error
-	var execerr error
-	var feeds []int64
-	rows, qerr := database.Query("SELECT id FROM feed")
+
+// Picks up feeds which are due according to their schedule or were queued
+// for an immediate refresh via `api`. With `queued` set, only the latter.
+func refresh_feeds (queued bool) {
+	var feeds []FeedStatus
+	due := "COALESCE(feed_status.next_fetch, 0) <= ? OR COALESCE(feed_status.refresh_requested, 0) > 0"
+	if queued { due = "COALESCE(feed_status.refresh_requested, 0) BETWEEN 1 AND ?" }
+	rows, qerr := database.Query(`SELECT feed.id, feed.uschema, feed.urn FROM feed
+				      LEFT JOIN feed_status ON feed_status.id = feed.id
+				      WHERE (`+due+`)
+				      AND COALESCE(feed_status.retry_after, 0) <= ?`, time.Now().Unix(), time.Now().Unix())
 	if qerr != nil {
 		// Log error and exit func to try again on next loop
 		log.Println(qerr)
@@ -85,136 +178,1023 @@ func refresh_feeds (storedir string) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var feedid int64
-		scanerr = rows.Scan(&feedid)
+		var fstatus FeedStatus
+		scanerr := rows.Scan(&fstatus.Id, &fstatus.Schema, &fstatus.URN)
 		if scanerr == nil {
-			feeds = append(feeds, feedid)
+			feeds = append(feeds, fstatus)
 		}
 	}
 
-	log.Printf("%d feeds\n", len(feeds))
+	if queued {
+		// Checked every few seconds, so stay quiet unless there is something to do
+		if len(feeds) == 0 { return }
+		log.Printf("%d feeds queued for refresh\n", len(feeds))
+	} else {
+		log.Printf("%d feeds due\n", len(feeds))
+	}
 
-	var netClient = &http.Client{ Timeout: time.Second * 5, }
+	var netClient = &http.Client{ Timeout: time.Second * 5, Transport: transport, }
+	limiter := new_host_limiter(k.Int("host.concurrency"), time.Duration(k.Int("host.delay")) * time.Millisecond)
 
-	for _, feedid := range feeds {
-		var fstatus FeedStatus
-		fstatus.Id = feedid
+	// Feed the queue host by host, so workers don't all end up waiting on the same server
+	queue := make(chan int64, len(feeds))
+	for _, feedid := range interleave_by_host(feeds) {
+		queue <- feedid
+	}
+	close(queue)
 
-		// Check that feed is set to active
-		var active int64
-		scanerr = database.QueryRow("SELECT COUNT(*) FROM feed_status WHERE id = ? AND active > 0", feedid).Scan(&active)
-		if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
-		if active == 0 {
+	var wg sync.WaitGroup
+	workers := lib.Value_or_default(k.Int("workers"), 1).(int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feedid := range queue {
+				refresh_feed(netClient, limiter, feedid)
+				// Not within refresh_feed, so large downloads don't hold up other feeds of the same host
+				mirror_enclosures(feedid)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func refresh_feed (netClient *http.Client, limiter *HostLimiter, feedid int64) {
+	var scanerr error
+	var execerr error
+
+	var fstatus FeedStatus
+	fstatus.Id = feedid
+
+	// A queued refresh is done either way, compiler waits for this
+	defer clear_refresh_request(feedid)
+
+	// Check that feed is set to active
+	var active int64
+	scanerr = database.QueryRow("SELECT COUNT(*) FROM feed_status WHERE id = ? AND active > 0", feedid).Scan(&active)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	if active == 0 {
+		// Feeds deactivated automatically are probed again once they are due
+		scanerr = database.QueryRow("SELECT COALESCE(deactivated,0) FROM feed_status WHERE id = ?", feedid).Scan(&fstatus.Deactivated)
+		if scanerr != nil && scanerr != sql.ErrNoRows { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+		if fstatus.Deactivated == 0 {
 			log.Printf("[%d] Feed is NOT active\n", feedid)
-			continue
+			return
 		}
+		log.Printf("[%d] Feed was deactivated after failures, probing again\n", feedid)
+	}
 
-		// Get feed details
-		scanerr = database.QueryRow("SELECT refreshed, updated FROM feed_status WHERE id = ?", feedid).Scan(&fstatus.Refreshed, &fstatus.Updated)
-		if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
-		scanerr = database.QueryRow("SELECT uschema, urn FROM feed WHERE id = ?", feedid).Scan(&fstatus.Schema, &fstatus.URN)
-		if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	// Get feed details
+	scanerr = database.QueryRow("SELECT refreshed, updated, COALESCE(etag,''), COALESCE(lastmodified,''), COALESCE(fetch_interval,0) FROM feed_status WHERE id = ?", feedid).Scan(&fstatus.Refreshed, &fstatus.Updated, &fstatus.ETag, &fstatus.LastModified, &fstatus.Interval)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	var credentials string
+	scanerr = database.QueryRow("SELECT uschema, urn, COALESCE(credentials,''), COALESCE(credentials_id,''), COALESCE(source,'feed'), COALESCE(mapping,'') FROM feed WHERE id = ?", feedid).Scan(&fstatus.Schema, &fstatus.URN, &credentials, &fstatus.CredentialsId, &fstatus.Source, &fstatus.Mapping)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
 
-		fstatus.URL= fstatus.Schema+"://"+fstatus.URN
-		fstatus.URLHash = sha256sum(fstatus.URL)
+	fstatus.URL= fstatus.Schema+"://"+fstatus.URN
+	fstatus.URLHash = feed_hash(fstatus, credentials)
 
-		subdirs  := k.Int("subdirs")
-		fstatus.File = storedir+"/"+lib.Subdirs(fstatus.URLHash, subdirs)
+	subdirs  := k.Int("subdirs")
+	fstatus.File = lib.Subdirs(fstatus.URLHash, subdirs)
 
-		// Check that we have an entry in the `feed_status` table
-		// Initialize as -1 to make sure 0 comes from the DB
-		var statuscount int64 = -1
-		scanerr = database.QueryRow("SELECT COUNT(*) FROM feed_status WHERE id = ?", feedid).Scan(&statuscount)
-		if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
-		if statuscount == 0 {
-			_, execerr = database.Exec("INSERT INTO feed_status (id) VALUES (?)", feedid)
+	// Check that we have an entry in the `feed_status` table
+	// Initialize as -1 to make sure 0 comes from the DB
+	var statuscount int64 = -1
+	scanerr = database.QueryRow("SELECT COUNT(*) FROM feed_status WHERE id = ?", feedid).Scan(&statuscount)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	if statuscount == 0 {
+		_, execerr = database.Exec("INSERT INTO feed_status (id) VALUES (?)", feedid)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+	}
+
+	request, reqerr := http.NewRequest("GET", fstatus.URL, nil)
+	if reqerr != nil {
+		log.Printf("[%d] HTTP Request Error -> %s\n", feedid, reqerr.Error())
+		fetch_attempts.Inc("error", "0")
+		record_failure(fstatus, 0, reqerr.Error(), 0)
+		return
+	}
+
+	if credentials != "" {
+		crederr := apply_credentials(request, credentials)
+		if crederr != nil {
+			log.Printf("[%d] Credentials Error -> %s\n", feedid, crederr.Error())
+			fetch_attempts.Inc("error", "0")
+			record_failure(fstatus, 0, "Credentials could not be decrypted", 0)
+			return
+		}
+	}
+
+	// Validators only make sense if we still have the file they refer to
+	if storage.Exists(fstatus.File) {
+		if fstatus.ETag != "" { request.Header.Set("If-None-Match", fstatus.ETag) }
+		if fstatus.LastModified != "" { request.Header.Set("If-Modified-Since", fstatus.LastModified) }
+	} else {
+		log.Printf("[%d] No file yet, downloading unconditionally\n", feedid)
+	}
+
+	limiter.acquire(request.URL.Host)
+	defer limiter.release(request.URL.Host)
+	start := time.Now()
+	defer func() { fetch_duration.Observe(time.Since(start).Seconds()) }()
+	response, geterr := netClient.Do(request)
+	if geterr != nil && lib.IsBlockedAddress(geterr) {
+		log.Printf("[%d] Rejected by SSRF protection -> %s\n", feedid, geterr.Error())
+		fetch_attempts.Inc("blocked", "0")
+		record_failure(fstatus, 0, "Rejected: "+geterr.Error(), 0)
+		return
+	}
+	if geterr != nil {
+		log.Printf("[%d] HTTP GET Error -> %s\n", feedid, geterr.Error())
+		fetch_attempts.Inc("error", "0")
+		record_failure(fstatus, 0, geterr.Error(), 0)
+		return
+	}
+	status := strconv.Itoa(response.StatusCode)
+
+	_, execerr = database.Exec("UPDATE feed_status SET refreshed = ? WHERE id = ?", time.Now().Unix(), feedid)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		log.Printf("[%d] Up-to-date\n", feedid)
+		fetch_attempts.Inc("not_modified", status)
+		record_success(fstatus, response.StatusCode)
+		// Leases need renewing even if the feed does not change
+		if fstatus.Source == "feed" { websub_discover(netClient, fstatus, response.Header) }
+		schedule_feed(fstatus, false, cache_max_age(response.Header))
+		track_redirects(fstatus, response)
+	case http.StatusOK:
+		log.Printf("[%d] Downloading %s -> %s\n", feedid, fstatus.URL, fstatus.File)
+		var dlbytes int64
+		body, converr := convert_source(fstatus, response)
+		dlerr := converr
+		if converr == nil {
+			dlbytes, dlerr = download_feed(body, fstatus.File)
+		}
+		if dlerr == nil {
+			log.Printf("[%d] Download successful (%d bytes)\n", feedid, dlbytes)
+			fetch_attempts.Inc("updated", status)
+			fetch_bytes.Add(float64(dlbytes))
+			_, execerr = database.Exec("UPDATE feed_status SET updated = ?, etag = ?, lastmodified = ? WHERE id = ?",
+						   time.Now().Unix(),
+						   response.Header.Get("ETag"),
+						   response.Header.Get("Last-Modified"),
+						   feedid)
+			if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+			_, execerr = database.Exec("UPDATE feed SET filename = ? WHERE id = ?", fstatus.File, feedid)
 			if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+			record_success(fstatus, response.StatusCode)
+			if fstatus.Source == "feed" { websub_discover(netClient, fstatus, response.Header) }
+			schedule_feed(fstatus, true, cache_max_age(response.Header))
+			track_redirects(fstatus, response)
+		} else {
+			log.Printf("[%d] Download FAILED -> %s\n", feedid, dlerr.Error())
+			fetch_attempts.Inc("invalid", status)
+			record_failure(fstatus, response.StatusCode, dlerr.Error(), 0)
 		}
+	case http.StatusGone:
+		log.Printf("[%d] Feed is gone, deactivating\n", feedid)
+		fetch_attempts.Inc("gone", status)
+		_, execerr = database.Exec("UPDATE feed_status SET active = 0, deactivated = 0, last_status = ?, last_error = ? WHERE id = ?",
+					   response.StatusCode, "Feed is gone", feedid)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		retry := parse_retry_after(response.Header.Get("Retry-After"))
+		log.Printf("[%d] Server asks us to back off (%s) -> %s\n", feedid, response.Status, retry)
+		fetch_attempts.Inc("failed", status)
+		record_failure(fstatus, response.StatusCode, "Server asks to back off "+response.Status, retry)
+	default:
+		log.Printf("[%d] Unexpected HTTP status -> %s\n", feedid, response.Status)
+		fetch_attempts.Inc("failed", status)
+		record_failure(fstatus, response.StatusCode, "Unexpected HTTP status "+response.Status, 0)
+	}
+	response.Body.Close()
+}
 
-		response, headerr := netClient.Head(fstatus.URL)
-		if headerr != nil {
-			log.Printf("[%d] HTTP HEAD Error -> %s\n", feedid, headerr.Error())
-			continue
+// Adds authentication and custom headers stored for a feed to the request
+func apply_credentials (request *http.Request, encrypted string) (error) {
+	creds, decerr := lib.Decrypt_credentials(encrypted, k.String("credentials.key"))
+	if decerr != nil { return decerr }
+
+	for header, value := range creds.Headers {
+		request.Header.Set(header, value)
+	}
+	if creds.Username != "" || creds.Password != "" {
+		request.SetBasicAuth(creds.Username, creds.Password)
+	}
+	if creds.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+creds.Token)
+	}
+
+	return nil
+}
+
+// Marks a refresh queued via `api` as done, whatever the outcome of the fetch
+func clear_refresh_request (feedid int64) {
+	_, execerr := database.Exec("UPDATE feed_status SET refresh_requested = 0 WHERE id = ? AND COALESCE(refresh_requested,0) > 0", feedid)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+}
+
+// Resets failure tracking and reactivates feeds which were deactivated automatically
+func record_success (fstatus FeedStatus, status int) {
+	if fstatus.Deactivated > 0 { log.Printf("[%d] Feed is reachable again, reactivating\n", fstatus.Id) }
+
+	_, execerr := database.Exec(`UPDATE feed_status SET last_status = ?, last_error = '', failures = 0, failing_since = 0,
+				     last_success = ?, active = 1, deactivated = 0, retry_after = 0 WHERE id = ?`,
+				     status, time.Now().Unix(), fstatus.Id)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+}
+
+// Counts a failed fetch, holds off further requests for `retry` (or an
+// exponential backoff if 0) and deactivates the feed once it has failed
+// too often or for too long
+func record_failure (fstatus FeedStatus, status int, message string, retry time.Duration) {
+	now := time.Now().Unix()
+
+	_, execerr := database.Exec(`UPDATE feed_status SET last_status = ?, last_error = ?, failures = COALESCE(failures,0) + 1,
+				     failing_since = CASE WHEN COALESCE(failing_since,0) = 0 THEN ? ELSE failing_since END WHERE id = ?`,
+				     status, lib.Maxlen(message, 255), now, fstatus.Id)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+
+	var failures int64
+	var since int64
+	scanerr := database.QueryRow("SELECT COALESCE(failures,0), COALESCE(failing_since,0) FROM feed_status WHERE id = ?", fstatus.Id).Scan(&failures, &since)
+	if scanerr != nil {
+		log.Printf("[%d] Database error: %s\n", fstatus.Id, scanerr)
+		return
+	}
+
+	// Even an explicit Retry-After is capped, so a feed can not lock itself out
+	maxbackoff := time.Duration(lib.Value_or_default(k.Int("backoff.max"), 1440).(int)) * time.Minute
+	if retry <= 0 { retry = backoff(failures) }
+	if retry > maxbackoff { retry = maxbackoff }
+	log.Printf("[%d] Not retrying before %s\n", fstatus.Id, time.Now().Add(retry).Format(time.RFC3339))
+	_, execerr = database.Exec("UPDATE feed_status SET retry_after = ? WHERE id = ?", time.Now().Add(retry).Unix(), fstatus.Id)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+
+	maxfailures := int64(k.Int("failures.max"))
+	maxage := int64(k.Int("failures.maxage")) * 3600
+	if (maxfailures > 0 && failures >= maxfailures) || (maxage > 0 && now - since >= maxage) {
+		reprobe := int64(lib.Value_or_default(k.Int("failures.reprobe"), 24).(int)) * 3600
+		if fstatus.Deactivated == 0 {
+			log.Printf("[%d] Deactivating feed after %d failures\n", fstatus.Id, failures)
+		}
+		_, execerr = database.Exec("UPDATE feed_status SET active = 0, deactivated = ?, next_fetch = ? WHERE id = ?", now, now + reprobe, fstatus.Id)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+	}
+}
+
+// Exponential backoff with jitter, doubling with every consecutive failure
+func backoff (failures int64) (time.Duration) {
+	delay := time.Duration(lib.Value_or_default(k.Int("backoff.base"), 5).(int)) * time.Minute
+	maxdelay := time.Duration(lib.Value_or_default(k.Int("backoff.max"), 1440).(int)) * time.Minute
+	for i := int64(1); i < failures && delay < maxdelay; i++ {
+		delay *= 2
+	}
+	if delay > maxdelay { delay = maxdelay }
+
+	// Spread retries over the second half of the delay
+	return delay / 2 + time.Duration(mrand.Int63n(int64(delay / 2) + 1))
+}
+
+// Retry-After may either be a number of seconds or an HTTP date
+func parse_retry_after (value string) (time.Duration) {
+	value = strings.TrimSpace(value)
+	if value == "" { return 0 }
+
+	seconds, converr := strconv.ParseInt(value, 10, 64)
+	if converr == nil { return time.Duration(seconds) * time.Second }
+
+	date, dateerr := http.ParseTime(value)
+	if dateerr == nil { return time.Until(date) }
+
+	return 0
+}
+
+// Follows the redirect chain of `response` and returns the URL reached
+// through permanent redirects (301/308) only, or "" if there were none
+func permanent_redirect (response *http.Response) (string) {
+	// The chain is linked backwards from the final request
+	var hops []*http.Request
+	for req := response.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		hops = append([]*http.Request{req}, hops...)
+	}
+
+	var target string
+	for _, hop := range hops {
+		if hop.Response.StatusCode != http.StatusMovedPermanently &&
+		   hop.Response.StatusCode != http.StatusPermanentRedirect {
+			break
+		}
+		target = hop.URL.String()
+	}
+
+	return target
+}
+
+// Rewrites the catalogue once a feed has been permanently redirected often enough
+func track_redirects (fstatus FeedStatus, response *http.Response) {
+	target := permanent_redirect(response)
+	if target == "" || target == fstatus.URL {
+		_, execerr := database.Exec("UPDATE feed_status SET redirect_target = '', redirect_count = 0 WHERE id = ?", fstatus.Id)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+		return
+	}
+
+	var previous string
+	var count int64
+	scanerr := database.QueryRow("SELECT COALESCE(redirect_target,''), COALESCE(redirect_count,0) FROM feed_status WHERE id = ?", fstatus.Id).Scan(&previous, &count)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, scanerr) }
+
+	if previous == target {
+		count++
+	} else {
+		count = 1
+	}
+	log.Printf("[%d] Permanently redirected to %s (%d time(s))\n", fstatus.Id, target, count)
+
+	if count < int64(lib.Value_or_default(k.Int("redirects.threshold"), 3).(int)) {
+		_, execerr := database.Exec("UPDATE feed_status SET redirect_target = ?, redirect_count = ? WHERE id = ?", target, count, fstatus.Id)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+		return
+	}
+
+	moveerr := move_feed(fstatus, target)
+	if moveerr != nil { log.Printf("[%d] Could not move feed to %s -> %s\n", fstatus.Id, target, moveerr) }
+}
+
+// Returns the hash the stored file of a feed is named after. Besides the URL, it
+// covers how sources are turned into a feed and the credentials of private feeds,
+// so none of them share a file with another.
+func feed_hash (fstatus FeedStatus, credentials string) (string) {
+	key := fstatus.URL
+	// The same page may be scraped in different ways
+	if fstatus.Source != "feed" { key += "\n"+fstatus.Source+"\n"+fstatus.Mapping }
+	if credentials != "" {
+		// Private feeds must not share a file with the public one or each other
+		private := fstatus.CredentialsId
+		if private == "" { private = credentials }
+		key += "\n"+private
+	}
+	return sha256sum(key)
+}
+
+// Points the catalogue entry at a new URL, or merges it into an existing
+// entry for that URL (repointing all compilations to it)
+func move_feed (fstatus FeedStatus, target string) (error) {
+	// Same normalisation as the API uses when adding feeds
+	schema, urn, normerr := lib.Normalize_url(target)
+	if normerr != nil { return normerr }
+
+	var existing int64
+	// Private feeds are only merged with those having the same credentials,
+	// public ones never with private ones
+	scanerr := database.QueryRow(`SELECT id FROM feed WHERE uschema = ? AND urn = ? AND COALESCE(source,'feed') = ? AND COALESCE(mapping,'') = ?
+				      AND COALESCE(credentials_id,'') = ? AND (? <> '' OR COALESCE(credentials,'') = '')`,
+				     schema, urn, fstatus.Source, fstatus.Mapping, fstatus.CredentialsId, fstatus.CredentialsId).Scan(&existing)
+	if scanerr != nil && scanerr != sql.ErrNoRows { return scanerr }
+
+	tx, txerr := database.Begin()
+	if txerr != nil { return txerr }
+	defer tx.Rollback()
+
+	var execerr error
+	if existing > 0 && existing != fstatus.Id {
+		log.Printf("[%d] Merging into feed %d (%s)\n", fstatus.Id, existing, target)
+		// Compilations which already contain the target would otherwise list it twice
+		_, execerr = tx.Exec(`DELETE FROM compilation_content WHERE feed_id = ? AND id IN
+				      (SELECT id FROM (SELECT id FROM compilation_content WHERE feed_id = ?) AS dupes)`, fstatus.Id, existing)
+		if execerr != nil { return execerr }
+		_, execerr = tx.Exec("UPDATE compilation_content SET feed_id = ? WHERE feed_id = ?", existing, fstatus.Id)
+		if execerr != nil { return execerr }
+		_, execerr = tx.Exec("DELETE FROM feed WHERE id = ?", fstatus.Id)
+		if execerr != nil { return execerr }
+		_, execerr = tx.Exec("DELETE FROM feed_status WHERE id = ?", fstatus.Id)
+		if execerr != nil { return execerr }
+	} else {
+		log.Printf("[%d] Moving to %s\n", fstatus.Id, target)
+		_, execerr = tx.Exec("UPDATE feed SET uschema = ?, urn = ? WHERE id = ?", schema, urn, fstatus.Id)
+		if execerr != nil { return execerr }
+		// Validators belong to the old URL, and the next fetch must happen right away
+		_, execerr = tx.Exec(`UPDATE feed_status SET redirect_target = '', redirect_count = 0,
+				      etag = '', lastmodified = '', next_fetch = 0 WHERE id = ?`, fstatus.Id)
+		if execerr != nil { return execerr }
+	}
+
+	return tx.Commit()
+}
+
+// Works out when a feed should be fetched next and stores it in `feed_status`
+func schedule_feed (fstatus FeedStatus, changed bool, maxage time.Duration) {
+	hints := feed_hints(fstatus.File)
+	hints.Pushed = websub_active(fstatus.Id)
+	interval := next_fetch_interval(hints, time.Duration(fstatus.Interval) * time.Second, changed, maxage)
+	next := skip_slots(time.Now().Add(interval), hints)
+
+	log.Printf("[%d] Next fetch in %s\n", fstatus.Id, time.Until(next).Round(time.Minute))
+	_, execerr := database.Exec("UPDATE feed_status SET fetch_interval = ?, next_fetch = ? WHERE id = ?", int64(interval.Seconds()), next.Unix(), fstatus.Id)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+}
+
+func next_fetch_interval (hints FeedHints, previous time.Duration, changed bool, maxage time.Duration) (time.Duration) {
+	minimum := time.Duration(k.Int("schedule.min")) * time.Minute
+	maximum := time.Duration(k.Int("schedule.max")) * time.Minute
+
+	// Best estimate first: how often items actually appear, then what the feed claims
+	estimate := hints.ItemGap
+	if estimate == 0 { estimate = hints.UpdatePeriod }
+	if estimate == 0 { estimate = previous }
+
+	// A feed that has been silent for longer than usual is probably dormant
+	if hints.Silence / 2 > estimate { estimate = hints.Silence / 2 }
+
+	// Nothing changed since last time, so back off gradually
+	if !changed && previous * 3 / 2 > estimate { estimate = previous * 3 / 2 }
+
+	// Updates are pushed to us, so polling is only a fallback
+	if hints.Pushed {
+		poll := time.Duration(k.Int("websub.poll")) * time.Minute
+		if poll > estimate { estimate = poll }
+	}
+
+	// The publisher asks us not to come back before these
+	if hints.TTL > estimate { estimate = hints.TTL }
+	if maxage > estimate { estimate = maxage }
+
+	if estimate < minimum { estimate = minimum }
+	if maximum > 0 && estimate > maximum { estimate = maximum }
+
+	return estimate
+}
+
+// Moves `t` forward until it is outside of skipHours/skipDays
+func skip_slots (t time.Time, hints FeedHints) (time.Time) {
+	// skipHours and skipDays are specified in GMT
+	t = t.UTC()
+	for i := 0; i < 7 * 24; i++ {
+		if !hints.SkipHours[t.Hour()] && !hints.SkipDays[t.Weekday()] { return t }
+		t = t.Truncate(time.Hour).Add(time.Hour)
+	}
+
+	// Everything is skipped, which makes no sense, so ignore it
+	return t
+}
+
+func feed_hints (file string) (FeedHints) {
+	var hints FeedHints
+	hints.SkipHours = make(map[int]bool)
+	hints.SkipDays = make(map[time.Weekday]bool)
+
+	data, readerr := read_stored(file)
+	if readerr != nil { return hints }
+	reader := bytes.NewReader(data)
+
+	feed, parseerr := gofeed.NewParser().Parse(reader)
+	if parseerr != nil { return hints }
+
+	// Median gap between the most recent items
+	var dates []time.Time
+	for _, item := range feed.Items {
+		if item.PublishedParsed != nil {
+			dates = append(dates, *item.PublishedParsed)
+		} else if item.UpdatedParsed != nil {
+			dates = append(dates, *item.UpdatedParsed)
 		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+	if len(dates) > 20 { dates = dates[:20] }
 
-		if !lib.File_exists(fstatus.File) {
-			log.Printf("[%d] No file yet, marking for download\n", feedid)
-			fstatus.Download = true
+	var gaps []time.Duration
+	for i := 1; i < len(dates); i++ {
+		gaps = append(gaps, dates[i-1].Sub(dates[i]))
+	}
+	if len(gaps) > 0 {
+		sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+		hints.ItemGap = gaps[len(gaps)/2]
+	}
+	if len(dates) > 0 && time.Since(dates[0]) > 0 {
+		hints.Silence = time.Since(dates[0])
+	}
+
+	// sy:updatePeriod / sy:updateFrequency (RSS 1.0 syndication module)
+	if sy, ok := feed.Extensions["sy"]; ok {
+		periods := map[string]time.Duration{"hourly": time.Hour,
+						    "daily": 24 * time.Hour,
+						    "weekly": 7 * 24 * time.Hour,
+						    "monthly": 30 * 24 * time.Hour,
+						    "yearly": 365 * 24 * time.Hour}
+		frequency := int64(1)
+		if len(sy["updateFrequency"]) > 0 {
+			f, converr := strconv.ParseInt(strings.TrimSpace(sy["updateFrequency"][0].Value), 10, 64)
+			if converr == nil && f > 0 { frequency = f }
+		}
+		if len(sy["updatePeriod"]) > 0 {
+			period := periods[strings.ToLower(strings.TrimSpace(sy["updatePeriod"][0].Value))]
+			hints.UpdatePeriod = period / time.Duration(frequency)
 		}
+	}
+
+	// ttl, skipHours and skipDays only exist in RSS
+	if feed.FeedType != "rss" { return hints }
+	_, seekerr := reader.Seek(0, io.SeekStart)
+	if seekerr != nil { return hints }
+	rp := rss.Parser{}
+	rssfeed, rsserr := rp.Parse(reader)
+	if rsserr != nil { return hints }
+
+	ttl, converr := strconv.ParseInt(strings.TrimSpace(rssfeed.TTL), 10, 64)
+	if converr == nil && ttl > 0 { hints.TTL = time.Duration(ttl) * time.Minute }
+
+	for _, hour := range rssfeed.SkipHours {
+		h, converr := strconv.Atoi(strings.TrimSpace(hour))
+		if converr == nil { hints.SkipHours[h % 24] = true }
+	}
+
+	weekdays := map[string]time.Weekday{"sunday": time.Sunday, "monday": time.Monday,
+					    "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+					    "thursday": time.Thursday, "friday": time.Friday,
+					    "saturday": time.Saturday}
+	for _, day := range rssfeed.SkipDays {
+		if wd, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]; ok { hints.SkipDays[wd] = true }
+	}
+
+	return hints
+}
+
+var max_age_regexp = regexp.MustCompile(`(?:^|[,\s])max-age=(\d+)`)
+
+func cache_max_age (header http.Header) (time.Duration) {
+	match := max_age_regexp.FindStringSubmatch(header.Get("Cache-Control"))
+	if len(match) < 2 { return 0 }
 
-		// we just checked, file should be there
-		file, _ := os.Stat(fstatus.File)
+	seconds, converr := strconv.ParseInt(match[1], 10, 64)
+	if converr != nil { return 0 }
 
-		// check for last-modified header, if present compare to modtime
-		if lib.File_exists(fstatus.File) {
-			serverts, tserr := time.Parse(time.RFC1123, response.Header.Get("Last-Modified"))
-			if tserr == nil {
-				// Server has given us a useable last-modified header
-				if serverts.After(file.ModTime()) {
-					log.Printf("[%d] Server has newer version (by %s), marking for download\n", feedid, serverts.Sub(file.ModTime()) )
-					fstatus.Download = true
-				}
+	return time.Duration(seconds) * time.Second
+}
+
+// Subscribes to the WebSub hub advertised by a feed, if any
+func websub_discover (nc *http.Client, fstatus FeedStatus, header http.Header) {
+	if k.String("websub.callback") == "" { return }
+
+	hub, topic := websub_links(fstatus.File, header)
+	if hub == "" { return }
+	if topic == "" { topic = fstatus.URL }
+
+	var oldhub string
+	var oldtopic string
+	var secret string
+	var requested int64
+	var expires int64
+	var verified int64
+	scanerr := database.QueryRow(`SELECT COALESCE(hub,''), COALESCE(topic,''), COALESCE(secret,''), COALESCE(requested,0),
+				      COALESCE(lease_expires,0), COALESCE(verified,0) FROM websub WHERE id = ?`, fstatus.Id).Scan(&oldhub, &oldtopic, &secret, &requested, &expires, &verified)
+	if scanerr != nil && scanerr != sql.ErrNoRows { log.Printf("[%d] Database error: %s\n", fstatus.Id, scanerr) }
+
+	now := time.Now().Unix()
+	if oldhub == hub && oldtopic == topic {
+		// Subscription is fine for at least another day
+		if verified > 0 && expires > now + 86400 { return }
+		// Hub has not verified our last request yet
+		if verified == 0 && requested > now - 3600 { return }
+	} else {
+		// New subscription, new secret
+		secret = random_hex(32)
+		_, execerr := database.Exec("DELETE FROM websub WHERE id = ?", fstatus.Id)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+		_, execerr = database.Exec("INSERT INTO websub (id, hub, topic, secret, requested, lease_expires, verified) VALUES (?,?,?,?,0,0,0)",
+					   fstatus.Id, hub, topic, secret)
+		if execerr != nil {
+			log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr)
+			return
+		}
+	}
+
+	// Hubs may verify before they respond, so the request has to be recorded first
+	_, execerr := database.Exec("UPDATE websub SET requested = ? WHERE id = ?", now, fstatus.Id)
+	if execerr != nil {
+		log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr)
+		return
+	}
+
+	log.Printf("[%d] Subscribing to %s via %s\n", fstatus.Id, topic, hub)
+	form := url.Values{"hub.mode": {"subscribe"},
+			   "hub.topic": {topic},
+			   "hub.callback": {strings.TrimSuffix(k.String("websub.callback"), "/")+"/"+strconv.FormatInt(fstatus.Id, 10)},
+			   "hub.secret": {secret},
+			   "hub.lease_seconds": {strconv.Itoa(k.Int("websub.lease"))}}
+	response, posterr := nc.PostForm(hub, form)
+	if posterr == nil {
+		response.Body.Close()
+		if response.StatusCode == http.StatusAccepted || response.StatusCode == http.StatusNoContent { return }
+		log.Printf("[%d] WebSub hub refused subscription -> %s\n", fstatus.Id, response.Status)
+	} else {
+		log.Printf("[%d] WebSub subscription failed -> %s\n", fstatus.Id, posterr.Error())
+	}
+
+	// Nothing is pending, so nothing can be verified
+	_, execerr = database.Exec("UPDATE websub SET requested = 0 WHERE id = ?", fstatus.Id)
+	if execerr != nil { log.Printf("[%d] Database error: %s\n", fstatus.Id, execerr) }
+}
+
+// Returns the hub and self links from HTTP Link headers or the feed itself
+func websub_links (file string, header http.Header) (string, string) {
+	var hub string
+	var self string
+
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			match := link_header_regexp.FindStringSubmatch(link)
+			if len(match) < 3 { continue }
+			for _, rel := range strings.Fields(match[2]) {
+				if rel == "hub" && hub == "" { hub = match[1] }
+				if rel == "self" && self == "" { self = match[1] }
 			}
 		}
+	}
+	if hub != "" { return hub, self }
 
-		// check for content-length header, if present compare to size
-		// Last modified may have already triggered the `Download` flag, so we don't always need to check size
-		if lib.File_exists(fstatus.File) && !fstatus.Download {
-			clength := response.Header.Get("Content-Length")
-			clint, converr := strconv.ParseInt(clength, 10, 64)
-			if converr == nil {
-				// We have a useable content-length
-				if clint != file.Size() {
-					log.Printf("[%d] Server has different size (%d) from local (%d), marking for download\n", feedid, clint, file.Size())
-					fstatus.Download = true
-				}
+	data, readerr := read_stored(file)
+	if readerr != nil { return hub, self }
+	reader := bytes.NewReader(data)
+
+	feedtype := gofeed.DetectFeedType(reader)
+	_, seekerr := reader.Seek(0, io.SeekStart)
+	if seekerr != nil { return hub, self }
+
+	switch feedtype {
+	case gofeed.FeedTypeAtom:
+		ap := atom.Parser{}
+		atomfeed, parseerr := ap.Parse(reader)
+		if parseerr != nil { return hub, self }
+		for _, link := range atomfeed.Links {
+			if link.Rel == "hub" && hub == "" { hub = link.Href }
+			if link.Rel == "self" && self == "" { self = link.Href }
+		}
+	case gofeed.FeedTypeRSS:
+		// RSS feeds use atom:link elements
+		rp := rss.Parser{}
+		rssfeed, parseerr := rp.Parse(reader)
+		if parseerr != nil { return hub, self }
+		for _, ns := range []string{"atom", "atom10"} {
+			for _, link := range rssfeed.Extensions[ns]["link"] {
+				if link.Attrs["rel"] == "hub" && hub == "" { hub = link.Attrs["href"] }
+				if link.Attrs["rel"] == "self" && self == "" { self = link.Attrs["href"] }
 			}
 		}
+	}
 
-		_, execerr = database.Exec("UPDATE feed_status SET refreshed = ? WHERE id = ?", time.Now().Unix(), feedid)
-		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
-		if fstatus.Download {
-			log.Printf("[%d] Downloading %s -> %s\n", feedid, fstatus.URL, fstatus.File)
-			dlsuccess, dlbytes := download_feed(netClient, feedid, fstatus.URL, fstatus.File)
-			if dlsuccess {
-				log.Printf("[%d] Download successful (%d bytes)\n", feedid, dlbytes)
-				_, execerr = database.Exec("UPDATE feed_status SET updated = ? WHERE id = ?", time.Now().Unix(), feedid)
-				if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
-				_, execerr = database.Exec("UPDATE feed SET filename = ? WHERE id = ?", fstatus.File, feedid)
-				if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
-			} else {
-				log.Printf("[%d] Download FAILED\n", feedid)
+	return hub, self
+}
+
+var link_header_regexp = regexp.MustCompile(`<([^>]+)>.*;\s*rel="?([^";]+)"?`)
+
+// A feed with a verified, unexpired subscription gets its updates pushed
+func websub_active (feedid int64) (bool) {
+	var count int64
+	scanerr := database.QueryRow("SELECT COUNT(*) FROM websub WHERE id = ? AND verified > 0 AND lease_expires > ?", feedid, time.Now().Unix()).Scan(&count)
+	if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+	return count > 0
+}
+
+func random_hex (n int) (string) {
+	buf := make([]byte, n)
+	_, rnderr := rand.Read(buf)
+	if rnderr != nil { log.Printf("crypto/rand failed: %s\n", rnderr) }
+	return fmt.Sprintf("%x", buf)
+}
+
+// Groups feeds by host and returns their IDs in round-robin order across hosts
+func interleave_by_host (feeds []FeedStatus) ([]int64) {
+	var result []int64
+	var hosts []string
+	byhost := make(map[string][]int64)
+
+	for _, feed := range feeds {
+		host := strings.SplitN(feed.URN, "/", 2)[0]
+		if _, seen := byhost[host]; !seen {
+			hosts = append(hosts, host)
+		}
+		byhost[host] = append(byhost[host], feed.Id)
+	}
+
+	for len(result) < len(feeds) {
+		for _, host := range hosts {
+			if len(byhost[host]) > 0 {
+				result = append(result, byhost[host][0])
+				byhost[host] = byhost[host][1:]
 			}
-		} else {
-			log.Printf("[%d] Up-to-date\n", feedid)
 		}
 	}
+
+	return result
+}
+
+func new_host_limiter (concurrency int, delay time.Duration) (*HostLimiter) {
+	if concurrency < 1 { concurrency = 1 }
+
+	return &HostLimiter{slots: make(map[string]chan struct{}),
+			    last: make(map[string]time.Time),
+			    concurrency: concurrency,
+			    delay: delay}
+}
+
+// Blocks until a request to `host` is allowed, both by concurrency and delay
+func (hl *HostLimiter) acquire (host string) {
+	hl.mutex.Lock()
+	slot, exists := hl.slots[host]
+	if !exists {
+		slot = make(chan struct{}, hl.concurrency)
+		hl.slots[host] = slot
+	}
+	hl.mutex.Unlock()
+
+	slot <- struct{}{}
+
+	for {
+		hl.mutex.Lock()
+		wait := time.Until(hl.last[host].Add(hl.delay))
+		if wait <= 0 {
+			hl.last[host] = time.Now()
+			hl.mutex.Unlock()
+			return
+		}
+		hl.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+func (hl *HostLimiter) release (host string) {
+	hl.mutex.Lock()
+	slot := hl.slots[host]
+	hl.mutex.Unlock()
+
+	<-slot
 }
 
 func sha256sum (s string) (string) {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
 }
 
-func download_feed (nc *http.Client, feedid int64, url string, file string) (bool, int64) {
-	fh, fherr := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
-	if fherr != nil {
-		log.Printf("[%d] File creation Error -> %s\n", feedid, fherr.Error())
-		return false, -1
+// Downloads the enclosures of recent items, if the feed is part of a compilation
+// which mirrors them, and removes those past retention or no longer needed
+func mirror_enclosures (feedid int64) {
+	// The smallest quota of all compilations mirroring this feed applies
+	var compilations []string
+	quotas := make(map[string]int64)
+	defquota := int64(lib.Value_or_default(k.Int("mirror.quota"), 1024).(int))
+	rows, qerr := database.Query(`SELECT compilation.id, COALESCE(compilation.mirror_quota,0) FROM compilation
+				      INNER JOIN compilation_content ON compilation_content.id = compilation.id
+				      WHERE compilation_content.feed_id = ? AND COALESCE(compilation.mirror,0) > 0`, feedid)
+	if qerr != nil {
+		log.Printf("[%d] Database error: %s\n", feedid, qerr)
+		return
+	}
+	for rows.Next() {
+		var cplid string
+		var quota int64
+		scanerr := rows.Scan(&cplid, &quota)
+		if scanerr != nil { continue }
+		if quota <= 0 { quota = defquota }
+		compilations = append(compilations, cplid)
+		quotas[cplid] = quota * 1048576
+	}
+	rows.Close()
+
+	retention := time.Duration(lib.Value_or_default(k.Int("mirror.retention"), 30).(int)) * 24 * time.Hour
+	cutoff := time.Now().Add(-retention)
+	if len(compilations) == 0 {
+		// Nobody mirrors this feed (anymore)
+		prune_enclosures(feedid, time.Now().Add(time.Hour))
+		forget_enclosures(feedid, nil)
+		return
 	}
+	prune_enclosures(feedid, cutoff)
+
+	// Blobs are written in one piece, too much for enclosures
+	if k.String("storage.type") == "database" {
+		log.Printf("[%d] Not mirroring enclosures, database storage is not supported\n", feedid)
+		return
+	}
+
+	var file string
+	scanerr := database.QueryRow("SELECT COALESCE(filename,'') FROM feed WHERE id = ?", feedid).Scan(&file)
+	if scanerr != nil || file == "" { return }
+	data, readerr := read_stored(file)
+	if readerr != nil { return }
+	feed, parseerr := gofeed.NewParser().Parse(bytes.NewReader(data))
+	if parseerr != nil { return }
+
+	client := &http.Client{Timeout: time.Duration(lib.Value_or_default(k.Int("mirror.timeout"), 600).(int)) * time.Second,
+			       Transport: transport}
+	maxsize := int64(lib.Value_or_default(k.Int("mirror.maxsize"), 200).(int)) * 1048576
+	mirrored := 0
+	current := make(map[string]bool)
+
+	for _, item := range feed.Items {
+		// Compiler only uses the first enclosure
+		if len(item.Enclosures) == 0 || item.Enclosures[0].URL == "" { continue }
+		enclurl := item.Enclosures[0].URL
+		current[enclurl] = true
+
+		// Every enclosure is recorded when first seen, mirrored or not
+		var stored string
+		var firstseen int64
+		scanerr = database.QueryRow("SELECT COALESCE(filename,''), COALESCE(first_seen,0) FROM enclosure WHERE feed_id = ? AND url = ?", feedid, enclurl).Scan(&stored, &firstseen)
+		if scanerr == sql.ErrNoRows {
+			firstseen = time.Now().Unix()
+			_, execerr := database.Exec("INSERT INTO enclosure (feed_id, url, filename, size, published, mirrored, first_seen) VALUES (?,?,'',0,0,0,?)", feedid, enclurl, firstseen)
+			if execerr != nil {
+				log.Printf("[%d] Database error: %s\n", feedid, execerr)
+				continue
+			}
+		} else if scanerr != nil {
+			log.Printf("[%d] Database error: %s\n", feedid, scanerr)
+			continue
+		}
+		if stored != "" { continue }
+
+		// Items without a date age from when their enclosure was first seen
+		published := time.Unix(firstseen, 0)
+		if item.PublishedParsed != nil {
+			published = *item.PublishedParsed
+		} else if item.UpdatedParsed != nil {
+			published = *item.UpdatedParsed
+		}
+		if published.Before(cutoff) { continue }
+
+		// Space left in the fullest compilation
+		limit := maxsize
+		for _, cplid := range compilations {
+			var used int64
+			scanerr = database.QueryRow(`SELECT COALESCE(SUM(enclosure.size),0) FROM enclosure
+						     INNER JOIN compilation_content ON compilation_content.feed_id = enclosure.feed_id
+						     WHERE compilation_content.id = ?`, cplid).Scan(&used)
+			if scanerr != nil { log.Printf("[%d] Database error: %s\n", feedid, scanerr) }
+			if quotas[cplid] - used < limit { limit = quotas[cplid] - used }
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(item.Enclosures[0].Length), 10, 64)
+		if limit <= 0 || length > limit {
+			log.Printf("[%d] Not mirroring %s, quota exceeded\n", feedid, enclurl)
+			continue
+		}
+
+		key := "enclosures/"+lib.Subdirs(sha256sum(strconv.FormatInt(feedid, 10)+"\n"+enclurl), k.Int("subdirs"))
+		if parsed, parseerr := url.Parse(enclurl); parseerr == nil {
+			// Players like to see the right extension
+			key += strings.ToLower(filepath.Ext(parsed.Path))
+		}
+		size, dlerr := download_enclosure(client, enclurl, key, limit)
+		if dlerr != nil {
+			log.Printf("[%d] Mirroring %s FAILED -> %s\n", feedid, enclurl, dlerr)
+			continue
+		}
+
+		_, execerr := database.Exec("UPDATE enclosure SET filename = ?, size = ?, published = ?, mirrored = ? WHERE feed_id = ? AND url = ?",
+					    key, size, published.Unix(), time.Now().Unix(), feedid, enclurl)
+		if execerr != nil {
+			log.Printf("[%d] Database error: %s\n", feedid, execerr)
+			continue
+		}
+		log.Printf("[%d] Mirrored %s (%d bytes)\n", feedid, enclurl, size)
+		enclosure_bytes.Add(float64(size))
+		mirrored++
+	}
+	forget_enclosures(feedid, current)
+
+	if mirrored > 0 {
+		// Compiler may have run already, it needs to pick up the new URLs
+		_, execerr := database.Exec("UPDATE feed_status SET updated = ? WHERE id = ?", time.Now().Unix(), feedid)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+	}
+}
+
+// Enclosures are too large to keep in memory, so they go through a temporary file
+func download_enclosure (client *http.Client, enclurl string, key string, maxsize int64) (int64, error) {
+	response, geterr := client.Get(enclurl)
+	if geterr != nil { return -1, geterr }
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK { return -1, fmt.Errorf("Unexpected HTTP status %s", response.Status) }
+	if response.ContentLength > maxsize { return -1, fmt.Errorf("Enclosure exceeds size limit of %d bytes", maxsize) }
+
+	fh, fherr := ioutil.TempFile("", "rssmix-enclosure-")
+	if fherr != nil { return -1, fherr }
+	defer os.Remove(fh.Name())
 	defer fh.Close()
 
-	data, derr := nc.Get(url)
-	if derr != nil {
-		log.Printf("[%d] HTTP GET Error -> %s\n", feedid, derr.Error())
-		return false, -1
+	// Read one byte more than allowed to detect oversized enclosures
+	size, copyerr := io.Copy(fh, io.LimitReader(response.Body, maxsize + 1))
+	if copyerr != nil { return -1, copyerr }
+	if size > maxsize { return -1, fmt.Errorf("Enclosure exceeds size limit of %d bytes", maxsize) }
+
+	_, seekerr := fh.Seek(0, io.SeekStart)
+	if seekerr != nil { return -1, seekerr }
+
+	return storage.Put(key, fh)
+}
+
+// Removes mirrored enclosures of items published before `cutoff`. Their rows
+// remain until the items leave the feed, so they are not mirrored again.
+func prune_enclosures (feedid int64, cutoff time.Time) {
+	var files []string
+	rows, qerr := database.Query("SELECT filename FROM enclosure WHERE feed_id = ? AND COALESCE(filename,'') <> '' AND published < ?", feedid, cutoff.Unix())
+	if qerr != nil {
+		log.Printf("[%d] Database error: %s\n", feedid, qerr)
+		return
+	}
+	for rows.Next() {
+		var file string
+		scanerr := rows.Scan(&file)
+		if scanerr == nil { files = append(files, file) }
+	}
+	rows.Close()
+
+	for _, file := range files {
+		delerr := storage.Delete(file)
+		if delerr != nil { log.Printf("[%d] Could not remove enclosure %s: %s\n", feedid, file, delerr) }
+		_, execerr := database.Exec("UPDATE enclosure SET filename = '', size = 0 WHERE feed_id = ? AND filename = ?", feedid, file)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
+	}
+	if len(files) > 0 { log.Printf("[%d] Removed %d mirrored enclosures\n", feedid, len(files)) }
+}
+
+// Removes the rows of enclosures which are not mirrored and no longer in the feed
+func forget_enclosures (feedid int64, current map[string]bool) {
+	var urls []string
+	rows, qerr := database.Query("SELECT url FROM enclosure WHERE feed_id = ? AND COALESCE(filename,'') = ''", feedid)
+	if qerr != nil {
+		log.Printf("[%d] Database error: %s\n", feedid, qerr)
+		return
+	}
+	for rows.Next() {
+		var enclurl string
+		scanerr := rows.Scan(&enclurl)
+		if scanerr == nil && !current[enclurl] { urls = append(urls, enclurl) }
+	}
+	rows.Close()
+
+	for _, enclurl := range urls {
+		_, execerr := database.Exec("DELETE FROM enclosure WHERE feed_id = ? AND url = ? AND COALESCE(filename,'') = ''", feedid, enclurl)
+		if execerr != nil { log.Printf("[%d] Database error: %s\n", feedid, execerr) }
 	}
-	defer data.Body.Close()
+}
+
+// Turns the response for non-feed sources into a feed, feeds are passed through
+func convert_source (fstatus FeedStatus, response *http.Response) (io.Reader, error) {
+	if fstatus.Source == "feed" { return response.Body, nil }
+
+	var mapping lib.SourceMapping
+	jderr := json.Unmarshal([]byte(fstatus.Mapping), &mapping)
+	if jderr != nil { return nil, fmt.Errorf("Invalid mapping -> %s", jderr) }
+
+	// The source itself is subject to the same size limit as feeds, a truncated
+	// one would be converted into a partial feed
+	maxsize := int64(lib.Value_or_default(k.Int("download.maxsize"), 10485760).(int))
+	data, readerr := ioutil.ReadAll(io.LimitReader(response.Body, maxsize + 1))
+	if readerr != nil { return nil, fmt.Errorf("Read Error -> %s", readerr) }
+	if int64(len(data)) > maxsize { return nil, fmt.Errorf("Source exceeds maximum size of %d bytes", maxsize) }
+	body := bytes.NewReader(data)
 
-	bytes, copyerr := io.Copy(fh, data.Body)
-	if copyerr != nil {
-		log.Printf("[%d] io.Copy Error -> %s\n", feedid, copyerr.Error())
-		return false, -1
+	var converted []byte
+	var converr error
+	switch fstatus.Source {
+	case "html":
+		converted, converr = lib.Scrape_html(body, response.Request.URL, mapping)
+	case "json":
+		converted, converr = lib.Map_json(body, response.Request.URL, mapping)
+	default:
+		converr = fmt.Errorf("Unknown source type %s", fstatus.Source)
 	}
+	if converr != nil { return nil, converr }
+
+	return bytes.NewReader(converted), nil
+}
+
+// Returns the stored copy of a feed
+func read_stored (file string) ([]byte, error) {
+	reader, openerr := storage.Get(file)
+	if openerr != nil { return nil, openerr }
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// Downloads into memory first, the stored copy of `file` is only replaced
+// once the feed is known to be complete, within size limits and parseable
+func download_feed (body io.Reader, file string) (int64, error) {
+	// Read one byte more than allowed to detect oversized feeds
+	maxsize := int64(lib.Value_or_default(k.Int("download.maxsize"), 10485760).(int))
+	data, readerr := ioutil.ReadAll(io.LimitReader(body, maxsize + 1))
+	if readerr != nil { return -1, fmt.Errorf("Read Error -> %s", readerr) }
+	if int64(len(data)) > maxsize { return -1, fmt.Errorf("Feed exceeds maximum size of %d bytes", maxsize) }
+
+	_, parseerr := gofeed.NewParser().Parse(bytes.NewReader(data))
+	if parseerr != nil { return -1, fmt.Errorf("Not a valid feed -> %s", parseerr) }
+
+	written, puterr := storage.Put(file, bytes.NewReader(data))
+	if puterr != nil { return -1, fmt.Errorf("Storage Error -> %s", puterr) }
 
-	return true, bytes
+	return written, nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+import "github.com/knadh/koanf"
+
+import "github.com/stevemeier/rssmix/lib"
+
+// Points `database` at a new database with the schema in `sql/sqlite3.txt`
+func test_database (t *testing.T) (func ()) {
+	dir, direrr := ioutil.TempDir("", "rssmix")
+	if direrr != nil { t.Fatal(direrr) }
+
+	schema, readerr := ioutil.ReadFile("../sql/sqlite3.txt")
+	if readerr != nil { t.Fatal(readerr) }
+
+	var dberr error
+	database, dberr = sqlx.Open("sqlite3", filepath.Join(dir, "rssmix.sql"))
+	if dberr != nil { t.Fatal(dberr) }
+	database.SetMaxOpenConns(1)
+	database.MustExec(string(schema))
+
+	return func () {
+		database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMoveFeedQuery (t *testing.T) {
+	defer test_database(t)()
+
+	database.MustExec(`INSERT INTO feed (id, uschema, urn) VALUES (1, 'http', 'example.com/feed'), (2, 'https', 'example.com/feed'),
+			   (3, 'http', 'example.com/other')`)
+	database.MustExec("INSERT INTO feed_status (id, etag, next_fetch) VALUES (1, 'abc', 1000), (3, '', 1000)")
+	database.MustExec("INSERT INTO compilation_content (id, feed_id) VALUES ('a', 1), ('b', 3)")
+
+	// The query selects a different document, so 1 is not merged into 2
+	moveerr := move_feed(FeedStatus{Id: 1, Source: "feed"}, "https://Example.com/feed?format=rss")
+	if moveerr != nil { t.Fatal(moveerr) }
+
+	var schema string
+	var urn string
+	scanerr := database.QueryRow("SELECT uschema, urn FROM feed WHERE id = 1").Scan(&schema, &urn)
+	if scanerr != nil { t.Fatal(scanerr) }
+	if schema+"://"+urn != "https://example.com/feed?format=rss" { t.Errorf("Feed moved to %s://%s", schema, urn) }
+
+	var count int
+	database.Get(&count, "SELECT COUNT(*) FROM feed WHERE id = 2")
+	if count != 1 { t.Errorf("Feed without the query was merged") }
+	database.Get(&count, "SELECT COUNT(*) FROM feed_status WHERE id = 1 AND etag = '' AND next_fetch = 0")
+	if count != 1 { t.Errorf("Validators of the old URL were kept") }
+
+	// The same redirect target again, now that it is in the catalogue
+	moveerr = move_feed(FeedStatus{Id: 3, Source: "feed"}, "https://example.com/feed?format=rss")
+	if moveerr != nil { t.Fatal(moveerr) }
+
+	database.Get(&count, "SELECT COUNT(*) FROM feed WHERE id = 3")
+	if count != 0 { t.Errorf("Feed was not merged into the one with the same query") }
+	database.Get(&count, "SELECT COUNT(*) FROM compilation_content WHERE feed_id = 1")
+	if count != 2 { t.Errorf("%d compilations contain the merged feed, want 2", count) }
+}
+
+func TestFeedHash (t *testing.T) {
+	url := "https://example.com/api/items?limit=50"
+	public := FeedStatus{URL: url, Source: "feed"}
+	private := FeedStatus{URL: url, Source: "feed", CredentialsId: "abc"}
+	titles := FeedStatus{URL: url, Source: "json", Mapping: `{"items":"$.items[*]","title":"$.title"}`, CredentialsId: "abc"}
+	names := FeedStatus{URL: url, Source: "json", Mapping: `{"items":"$.items[*]","title":"$.name"}`, CredentialsId: "abc"}
+
+	// Files of public feeds keep their names
+	if feed_hash(public, "") != sha256sum(url) { t.Errorf("Public feed is stored as %s", feed_hash(public, "")) }
+
+	hashes := make(map[string]string)
+	for name, hash := range map[string]string{"public": feed_hash(public, ""),
+						  "private": feed_hash(private, "encrypted"),
+						  "source": feed_hash(titles, "encrypted"),
+						  "other mapping": feed_hash(names, "encrypted"),
+						  "other credentials": feed_hash(FeedStatus{URL: url, Source: "json", Mapping: titles.Mapping, CredentialsId: "def"}, "encrypted")} {
+		if other, ok := hashes[hash]; ok { t.Errorf("The %s and %s feed share a file", name, other) }
+		hashes[hash] = name
+	}
+}
+
+func TestMirrorUndatedEnclosure (t *testing.T) {
+	defer test_database(t)()
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write([]byte("episode"))
+	}))
+	defer server.Close()
+	// The server is local, which the address guard would refuse
+	transport = http.DefaultTransport.(*http.Transport)
+
+	dir, direrr := ioutil.TempDir("", "rssmix")
+	if direrr != nil { t.Fatal(direrr) }
+	defer os.RemoveAll(dir)
+	storage = &lib.FileStorage{Root: dir}
+
+	// The item has no date
+	feed := `<rss version="2.0"><channel><title>Podcast</title><item><title>Episode</title>
+		 <enclosure url="`+server.URL+`/episode.mp3" length="7" type="audio/mpeg"/></item></channel></rss>`
+	_, puterr := storage.Put("feed", strings.NewReader(feed))
+	if puterr != nil { t.Fatal(puterr) }
+	database.MustExec("INSERT INTO feed (id, uschema, urn, filename) VALUES (1, 'https', 'example.com/podcast', 'feed')")
+	database.MustExec("INSERT INTO compilation (id, mirror) VALUES ('a', 1)")
+	database.MustExec("INSERT INTO compilation_content (id, feed_id) VALUES ('a', 1)")
+
+	mirror_enclosures(1)
+	mirror_enclosures(1)
+	if n := atomic.LoadInt32(&downloads); n != 1 { t.Fatalf("Enclosure was downloaded %d times, want 1", n) }
+
+	// Past retention, based on when it was first seen
+	past := time.Now().Add(-40 * 24 * time.Hour).Unix()
+	database.MustExec("UPDATE enclosure SET first_seen = ?, published = ?", past, past)
+	mirror_enclosures(1)
+	mirror_enclosures(1)
+	if atomic.LoadInt32(&downloads) != 1 { t.Errorf("Enclosure past retention was downloaded again") }
+
+	var file string
+	scanerr := database.QueryRow("SELECT filename FROM enclosure WHERE feed_id = 1").Scan(&file)
+	if scanerr != nil || file != "" { t.Errorf("Enclosure past retention is still mirrored as %q (%v)", file, scanerr) }
+	if objects, _ := storage.List(); len(objects) != 1 { t.Errorf("%d objects in storage, want only the feed", len(objects)) }
+
+	// Once the item is gone, so is its row
+	_, puterr = storage.Put("feed", strings.NewReader(`<rss version="2.0"><channel><title>Podcast</title></channel></rss>`))
+	if puterr != nil { t.Fatal(puterr) }
+	mirror_enclosures(1)
+	var rows int
+	database.Get(&rows, "SELECT COUNT(*) FROM enclosure")
+	if rows != 0 { t.Errorf("%d enclosure rows are left", rows) }
+}
+
+func TestConvertSourceMaxsize (t *testing.T) {
+	defer func (saved *koanf.Koanf) { k = saved }(k)
+	k = koanf.New(".")
+	k.Set("download.maxsize", 200)
+
+	fstatus := FeedStatus{Source: "json", Mapping: `{"items":"$.items[*]","title":"$.title"}`}
+	source := func (items int) (*http.Response) {
+		var titles []string
+		for i := 0; i < items; i++ { titles = append(titles, `{"title":"Item"}`) }
+		request, _ := http.NewRequest("GET", "https://example.com/api/items?limit=50", nil)
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(`{"items":[`+strings.Join(titles, ",")+`]}`)), Request: request}
+	}
+
+	_, converr := convert_source(fstatus, source(5))
+	if converr != nil { t.Errorf("Source within the limit failed: %s", converr) }
+
+	// Cut off, this would be invalid JSON, or a feed with fewer items
+	_, converr = convert_source(fstatus, source(50))
+	if converr == nil || !strings.Contains(converr.Error(), "maximum size") { t.Errorf("Oversized source returned %v, want a size error", converr) }
+}
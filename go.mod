@@ -18,9 +18,13 @@ require github.com/mmcdole/gofeed v1.1.3
 
 require github.com/fasthttp/router v1.4.4
 
+require github.com/PuerkitoBio/goquery v1.5.1
+
+require github.com/andybalholm/cascadia v1.1.0
+
 require (
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/valyala/fasthttp v1.34.0
-	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/net v0.33.0
 )
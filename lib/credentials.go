@@ -0,0 +1,80 @@
+package lib
+
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "io"
+
+// Optional credentials and extra request headers for a feed
+type Credentials struct {
+	Username	string			`json:"username,omitempty"`
+	Password	string			`json:"password,omitempty"`
+	Token		string			`json:"token,omitempty"`
+	Headers		map[string]string	`json:"headers,omitempty"`
+}
+
+func (c Credentials) Empty () (bool) {
+	return c.Username == "" && c.Password == "" && c.Token == "" && len(c.Headers) == 0
+}
+
+// Encrypts credentials with AES-GCM, the key is derived from `secret`
+func Encrypt_credentials (c Credentials, secret string) (string, error) {
+	if secret == "" { return "", errors.New("No credentials key configured") }
+
+	plaintext, jmerr := json.Marshal(c)
+	if jmerr != nil { return "", jmerr }
+
+	gcm, gcmerr := credentials_cipher(secret)
+	if gcmerr != nil { return "", gcmerr }
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, rnderr := io.ReadFull(rand.Reader, nonce)
+	if rnderr != nil { return "", rnderr }
+
+	// The nonce is stored in front of the ciphertext
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func Decrypt_credentials (s string, secret string) (Credentials, error) {
+	var c Credentials
+	if secret == "" { return c, errors.New("No credentials key configured") }
+
+	data, b64err := base64.StdEncoding.DecodeString(s)
+	if b64err != nil { return c, b64err }
+
+	gcm, gcmerr := credentials_cipher(secret)
+	if gcmerr != nil { return c, gcmerr }
+	if len(data) < gcm.NonceSize() { return c, errors.New("Credentials are too short") }
+
+	plaintext, decerr := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if decerr != nil { return c, decerr }
+
+	jderr := json.Unmarshal(plaintext, &c)
+	return c, jderr
+}
+
+// Identifies credentials without revealing them. Feeds with credentials are
+// catalogued by URL and this, so only compilations knowing them share a feed.
+func Credentials_id (c Credentials, secret string) (string) {
+	if c.Empty() { return "" }
+
+	// Maps are marshalled sorted by key, so equal credentials get the same ID
+	data, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func credentials_cipher (secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, blockerr := aes.NewCipher(key[:])
+	if blockerr != nil { return nil, blockerr }
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package lib
+
+// Keys for recognising the same item in several feeds of a compilation
+
+import "net/url"
+import "sort"
+import "strings"
+import "unicode"
+
+// Item properties duplicates can be detected by
+var DedupKeys = []string{"guid", "link", "title"}
+
+// Which of the duplicates is kept, by publication date
+var DedupKeep = []string{"oldest", "newest"}
+
+// Query parameters which only serve tracking and never change the content
+var tracking_params = []string{"fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid",
+			       "mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok", "ref", "ref_src"}
+
+// Returns the comma-separated keys stored in `compilation.dedup`, ignoring unknown ones
+func Parse_dedup (s string) ([]string) {
+	var result []string
+	for _, key := range strings.Split(s, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if contains_string(DedupKeys, key) && !contains_string(result, key) { result = append(result, key) }
+	}
+	return result
+}
+
+func Valid_dedup_key (key string) (bool) {
+	return contains_string(DedupKeys, key)
+}
+
+func Valid_dedup_keep (keep string) (bool) {
+	return contains_string(DedupKeep, keep)
+}
+
+// Returns `link` with tracking parameters, fragment, default port and
+// trailing slash removed, and scheme and host normalized. Links which
+// do not parse are returned unchanged.
+func Canonical_link (link string) (string) {
+	u, parseerr := url.Parse(strings.TrimSpace(link))
+	if parseerr != nil || u.Host == "" { return link }
+
+	// The same story is often linked via http and https, with and without www
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "http" { scheme = "https" }
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	port := u.Port()
+	if port != "" && port != "80" && port != "443" { host += ":"+port }
+
+	query := u.Query()
+	for param := range query {
+		if is_tracking_param(param) { query.Del(param) }
+	}
+
+	path := u.EscapedPath()
+	if len(path) > 1 { path = strings.TrimSuffix(path, "/") }
+	if path == "/" { path = "" }
+
+	result := scheme+"://"+host+path
+	// Encode sorts by key, so parameter order does not matter
+	if len(query) > 0 {
+		for _, values := range query { sort.Strings(values) }
+		result += "?"+query.Encode()
+	}
+	return result
+}
+
+func is_tracking_param (name string) (bool) {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || contains_string(tracking_params, name)
+}
+
+// Returns `title` in lower case, with punctuation removed and whitespace collapsed
+func Normalize_title (title string) (string) {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) (bool) {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
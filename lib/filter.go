@@ -0,0 +1,346 @@
+package lib
+
+// Filter expressions select the items of a compilation, e.g.
+//   title ~ "(?i)golang" AND NOT (category = "sponsored" OR host = "ads.example.com")
+//   enclosure ~ "^audio/" AND published > -7d
+// Fields are title, description, content, author, category, host (of the link),
+// enclosure (MIME type) and published (the update date, if an item has none).
+// Text fields support = and != (ignoring case) as well as ~ and !~ (regular
+// expressions), published supports <, <=, > and >= with a date or an age like
+// -12h, -7d or -2w. Operators are AND, OR and NOT (or &&, || and !), grouped
+// by parentheses. Expressions are stored as JSON.
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/url"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/mmcdole/gofeed"
+
+type FilterExpr struct {
+	Op		string		`json:"op"`
+	Field		string		`json:"field,omitempty"`
+	Value		string		`json:"value,omitempty"`
+	Args		[]*FilterExpr	`json:"args,omitempty"`
+	re		*regexp.Regexp
+	date		time.Time
+	age		time.Duration
+}
+
+var filter_fields = map[string][]string{
+	"title":	{"=", "!=", "~", "!~"},
+	"description":	{"=", "!=", "~", "!~"},
+	"content":	{"=", "!=", "~", "!~"},
+	"author":	{"=", "!=", "~", "!~"},
+	"category":	{"=", "!=", "~", "!~"},
+	"host":		{"=", "!=", "~", "!~"},
+	"enclosure":	{"=", "!=", "~", "!~"},
+	"published":	{"<", "<=", ">", ">="},
+}
+
+var relative_age = regexp.MustCompile(`^-(\d+)([hdw])$`)
+
+// Parses and validates an expression
+func Parse_filter (s string) (*FilterExpr, error) {
+	tokens, tokenerr := filter_tokens(s)
+	if tokenerr != nil { return nil, tokenerr }
+	if len(tokens) == 0 { return nil, errors.New("Empty filter expression") }
+
+	p := &filter_parser{tokens: tokens}
+	expr, parseerr := p.parse_or()
+	if parseerr != nil { return nil, parseerr }
+	if p.pos < len(p.tokens) { return nil, fmt.Errorf("Unexpected %q in filter expression", p.tokens[p.pos].text) }
+
+	return expr, expr.compile()
+}
+
+// Loads an expression as stored in the database
+func Load_filter (data string) (*FilterExpr, error) {
+	var expr FilterExpr
+	jsonerr := json.Unmarshal([]byte(data), &expr)
+	if jsonerr != nil { return nil, jsonerr }
+	return &expr, expr.compile()
+}
+
+func (e *FilterExpr) Json () (string) {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// Checks the expression and prepares regular expressions and dates
+func (e *FilterExpr) compile () (error) {
+	switch e.Op {
+	case "and", "or":
+		if len(e.Args) < 2 { return fmt.Errorf("%s needs at least two operands", strings.ToUpper(e.Op)) }
+	case "not":
+		if len(e.Args) != 1 { return errors.New("NOT needs exactly one operand") }
+	default:
+		ops, ok := filter_fields[e.Field]
+		if !ok { return fmt.Errorf("Unknown filter field %q", e.Field) }
+		if !contains_string(ops, e.Op) { return fmt.Errorf("Operator %s can not be used with %s", e.Op, e.Field) }
+
+		switch {
+		case e.Op == "~" || e.Op == "!~":
+			re, reerr := regexp.Compile(e.Value)
+			if reerr != nil { return fmt.Errorf("Invalid regular expression %q: %s", e.Value, reerr) }
+			e.re = re
+		case e.Field == "published":
+			if m := relative_age.FindStringSubmatch(e.Value); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				e.age = time.Duration(n) * map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[m[2]]
+			} else {
+				date, dateerr := Parse_date(e.Value)
+				if dateerr != nil { return dateerr }
+				e.date = date
+			}
+		}
+		return nil
+	}
+
+	for _, arg := range e.Args {
+		if arg == nil { return errors.New("Empty operand in filter expression") }
+		argerr := arg.compile()
+		if argerr != nil { return argerr }
+	}
+	return nil
+}
+
+func (e *FilterExpr) Match (item *gofeed.Item) (bool) {
+	switch e.Op {
+	case "and":
+		for _, arg := range e.Args {
+			if !arg.Match(item) { return false }
+		}
+		return true
+	case "or":
+		for _, arg := range e.Args {
+			if arg.Match(item) { return true }
+		}
+		return false
+	case "not":
+		return !e.Args[0].Match(item)
+	case "!=":
+		return !e.match_any(item, "=")
+	case "!~":
+		return !e.match_any(item, "~")
+	}
+
+	if e.Field == "published" {
+		// Atom entries may only have <updated>
+		parsed := item.PublishedParsed
+		if parsed == nil { parsed = item.UpdatedParsed }
+		if parsed == nil { return false }
+		published := *parsed
+		date := e.date
+		if e.age > 0 { date = time.Now().Add(-e.age) }
+		switch e.Op {
+		case "<":	return published.Before(date)
+		case "<=":	return !published.After(date)
+		case ">":	return published.After(date)
+		case ">=":	return !published.Before(date)
+		}
+		return false
+	}
+
+	return e.match_any(item, e.Op)
+}
+
+// Fields with several values match if any of them does
+func (e *FilterExpr) match_any (item *gofeed.Item, op string) (bool) {
+	for _, value := range filter_values(item, e.Field) {
+		if op == "=" && strings.EqualFold(value, e.Value) { return true }
+		if op == "~" && e.re.MatchString(value) { return true }
+	}
+	return false
+}
+
+func filter_values (item *gofeed.Item, field string) ([]string) {
+	var result []string
+	switch field {
+	case "title":
+		result = append(result, item.Title)
+	case "description":
+		result = append(result, item.Description)
+	case "content":
+		result = append(result, item.Content)
+	case "author":
+		for _, author := range item.Authors {
+			if author != nil { result = append(result, author.Name) }
+		}
+		if len(result) == 0 && item.Author != nil { result = append(result, item.Author.Name) }
+	case "category":
+		result = append(result, item.Categories...)
+	case "host":
+		u, parseerr := url.Parse(item.Link)
+		if parseerr == nil { result = append(result, u.Hostname()) }
+	case "enclosure":
+		for _, enclosure := range item.Enclosures {
+			if enclosure != nil { result = append(result, enclosure.Type) }
+		}
+	}
+	return result
+}
+
+// Returns the expression in the syntax it is parsed from
+func (e *FilterExpr) String () (string) {
+	switch e.Op {
+	case "and", "or":
+		var parts []string
+		for _, arg := range e.Args {
+			part := arg.String()
+			if arg.Op == "and" || arg.Op == "or" { part = "("+part+")" }
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, " "+strings.ToUpper(e.Op)+" ")
+	case "not":
+		arg := e.Args[0].String()
+		if e.Args[0].Op == "and" || e.Args[0].Op == "or" { arg = "("+arg+")" }
+		return "NOT "+arg
+	}
+
+	value := strings.Replace(e.Value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return e.Field+" "+e.Op+" \""+value+"\""
+}
+
+// Returns patterns as stored in `filter_inc`/`filter_exc`, a JSON array,
+// as patterns may contain commas and even newlines
+func Join_patterns (patterns []string) (string) {
+	if len(patterns) == 0 { return "" }
+	data, _ := json.Marshal(patterns)
+	return string(data)
+}
+
+// Splits `filter_inc`/`filter_exc`. Rows not holding a JSON array are from before
+// `Join_patterns`, which separated patterns by newlines or, originally, by commas.
+func Split_patterns (s string) ([]string) {
+	if s == "" { return []string{} }
+
+	var patterns []string
+	if strings.HasPrefix(s, "[") && json.Unmarshal([]byte(s), &patterns) == nil { return patterns }
+
+	if strings.Contains(s, "\n") { return strings.Split(s, "\n") }
+	return strings.Split(s, ",")
+}
+
+type filter_token struct {
+	text		string
+	quoted		bool
+}
+
+func filter_tokens (s string) ([]filter_token, error) {
+	var tokens []filter_token
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filter_token{text: string(c)})
+			i++
+		case c == '"':
+			// Only \" and \\ are escapes, so regular expressions need no double escaping
+			var value strings.Builder
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') { i++ }
+				value.WriteByte(s[i])
+			}
+			if i >= len(s) { return nil, errors.New("Unterminated string in filter expression") }
+			tokens = append(tokens, filter_token{text: value.String(), quoted: true})
+			i++
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, filter_token{text: s[i:i+2]})
+			i += 2
+		case strings.ContainsRune("<>=!~", rune(c)):
+			end := i + 1
+			if end < len(s) && (s[end] == '=' || s[end] == '~') { end++ }
+			tokens = append(tokens, filter_token{text: s[i:end]})
+			i = end
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\n\r()\"<>=!~&|", rune(s[end])) { end++ }
+			if end == i { return nil, fmt.Errorf("Unexpected %q in filter expression", string(c)) }
+			tokens = append(tokens, filter_token{text: s[i:end]})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type filter_parser struct {
+	tokens		[]filter_token
+	pos		int
+}
+
+func (p *filter_parser) peek () (string) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted { return "" }
+	return strings.ToUpper(p.tokens[p.pos].text)
+}
+
+func (p *filter_parser) parse_or () (*FilterExpr, error) {
+	left, parseerr := p.parse_and()
+	if parseerr != nil { return nil, parseerr }
+
+	expr := &FilterExpr{Op: "or", Args: []*FilterExpr{left}}
+	for p.peek() == "OR" || p.peek() == "||" {
+		p.pos++
+		right, parseerr := p.parse_and()
+		if parseerr != nil { return nil, parseerr }
+		expr.Args = append(expr.Args, right)
+	}
+
+	if len(expr.Args) == 1 { return left, nil }
+	return expr, nil
+}
+
+func (p *filter_parser) parse_and () (*FilterExpr, error) {
+	left, parseerr := p.parse_unary()
+	if parseerr != nil { return nil, parseerr }
+
+	expr := &FilterExpr{Op: "and", Args: []*FilterExpr{left}}
+	for p.peek() == "AND" || p.peek() == "&&" {
+		p.pos++
+		right, parseerr := p.parse_unary()
+		if parseerr != nil { return nil, parseerr }
+		expr.Args = append(expr.Args, right)
+	}
+
+	if len(expr.Args) == 1 { return left, nil }
+	return expr, nil
+}
+
+func (p *filter_parser) parse_unary () (*FilterExpr, error) {
+	switch p.peek() {
+	case "NOT", "!":
+		p.pos++
+		arg, parseerr := p.parse_unary()
+		if parseerr != nil { return nil, parseerr }
+		return &FilterExpr{Op: "not", Args: []*FilterExpr{arg}}, nil
+	case "(":
+		p.pos++
+		expr, parseerr := p.parse_or()
+		if parseerr != nil { return nil, parseerr }
+		if p.peek() != ")" { return nil, errors.New("Missing ) in filter expression") }
+		p.pos++
+		return expr, nil
+	}
+
+	// field op value
+	if p.pos+3 > len(p.tokens) { return nil, errors.New("Incomplete condition in filter expression") }
+	field := p.tokens[p.pos]
+	op := p.tokens[p.pos+1]
+	value := p.tokens[p.pos+2]
+	if field.quoted { return nil, fmt.Errorf("Expected a field name instead of %q", field.text) }
+	if op.quoted { return nil, fmt.Errorf("Expected an operator instead of %q", op.text) }
+	if !value.quoted && (value.text == "(" || value.text == ")") { return nil, fmt.Errorf("Expected a value instead of %q", value.text) }
+	p.pos += 3
+
+	return &FilterExpr{Op: op.text, Field: strings.ToLower(field.text), Value: value.text}, nil
+}
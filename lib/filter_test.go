@@ -0,0 +1,135 @@
+package lib
+
+import "reflect"
+import "testing"
+import "time"
+
+import "github.com/mmcdole/gofeed"
+
+func TestSplitPatterns (t *testing.T) {
+	tests := []struct {
+		stored		string
+		want		[]string
+	}{
+		{"", []string{}},
+		{`["a{1,3}"]`, []string{"a{1,3}"}},
+		{`["foo","bar, baz"]`, []string{"foo", "bar, baz"}},
+		{`["line\nbreak"]`, []string{"line\nbreak"}},
+		// Separated by newlines
+		{"a{1,3}\nfoo", []string{"a{1,3}", "foo"}},
+		// Separated by commas, as originally stored
+		{"foo,bar", []string{"foo", "bar"}},
+		{"foo", []string{"foo"}},
+		// Not a JSON array after all
+		{"[abc],def", []string{"[abc]", "def"}},
+	}
+
+	for _, test := range tests {
+		got := Split_patterns(test.stored)
+		if !reflect.DeepEqual(got, test.want) { t.Errorf("Split_patterns(%q) = %q, want %q", test.stored, got, test.want) }
+	}
+}
+
+func TestJoinPatterns (t *testing.T) {
+	for _, patterns := range [][]string{{"a{1,3}"}, {"foo", "bar, baz"}, {"line\nbreak", `"quoted"`}} {
+		got := Split_patterns(Join_patterns(patterns))
+		if !reflect.DeepEqual(got, patterns) { t.Errorf("Split_patterns(Join_patterns(%q)) = %q", patterns, got) }
+	}
+	if Join_patterns(nil) != "" { t.Errorf("Join_patterns(nil) = %q, want empty", Join_patterns(nil)) }
+}
+
+func TestFilterMatch (t *testing.T) {
+	now := time.Now()
+	hours := func(h int) (*time.Time) {
+		date := now.Add(-time.Duration(h) * time.Hour)
+		return &date
+	}
+	item := &gofeed.Item{Title: "Go 1.16 released",
+			     Description: "The Go team announces a new release",
+			     Link: "https://blog.golang.org/go1.16",
+			     Authors: []*gofeed.Person{{Name: "Alice"}, {Name: "Bob"}},
+			     Categories: []string{"Release", "News"},
+			     Enclosures: []*gofeed.Enclosure{{URL: "https://example.com/a.mp3", Type: "audio/mpeg"}},
+			     PublishedParsed: hours(48)}
+
+	tests := []struct {
+		expr		string
+		want		bool
+	}{
+		{`title = "go 1.16 released"`, true},
+		{`title != "Go 1.16 released"`, false},
+		{`title ~ "(?i)^go"`, true},
+		{`title !~ "^Rust"`, true},
+		{`author = "bob"`, true},
+		{`author != "carol"`, true},
+		{`category = "news"`, true},
+		{`category !~ "^Sponsored"`, true},
+		{`host = "blog.golang.org"`, true},
+		{`enclosure ~ "^audio/"`, true},
+		{`description ~ "release" AND NOT category = "sponsored"`, true},
+		{`title ~ "Rust" OR category = "release"`, true},
+		{`title ~ "Rust" || (author = "alice" && !host = "example.com")`, true},
+		{`published > -7d`, true},
+		{`published > -1d`, false},
+		{`published >= -72h`, true},
+		{`published < -1w`, false},
+		{`published <= -24h`, true},
+		{`published > "2001-01-01T00:00:00Z"`, true},
+		{`published < "2001-01-01T00:00:00Z"`, false},
+	}
+
+	for _, test := range tests {
+		expr, parseerr := Parse_filter(test.expr)
+		if parseerr != nil {
+			t.Errorf("Parse_filter(%q) failed: %s", test.expr, parseerr)
+			continue
+		}
+		if got := expr.Match(item); got != test.want { t.Errorf("%q matches %t, want %t", test.expr, got, test.want) }
+
+		// Expressions are stored as JSON and shown as text
+		loaded, loaderr := Load_filter(expr.Json())
+		if loaderr != nil || loaded.Match(item) != test.want { t.Errorf("%q does not survive JSON: %v", test.expr, loaderr) }
+		reparsed, parseerr := Parse_filter(expr.String())
+		if parseerr != nil || reparsed.String() != expr.String() { t.Errorf("%q is shown as %q, which does not parse back", test.expr, expr.String()) }
+	}
+}
+
+func TestFilterUpdated (t *testing.T) {
+	updated := time.Now().Add(-time.Hour)
+	entry := &gofeed.Item{Title: "Atom entry", UpdatedParsed: &updated}
+	undated := &gofeed.Item{Title: "No date"}
+
+	expr, parseerr := Parse_filter(`published > -7d`)
+	if parseerr != nil { t.Fatal(parseerr) }
+	if !expr.Match(entry) { t.Errorf("Entry updated an hour ago does not match %q", expr.String()) }
+	if expr.Match(undated) { t.Errorf("Entry without a date matches %q", expr.String()) }
+}
+
+func TestFilterInvalid (t *testing.T) {
+	for _, s := range []string{
+		``,
+		`title`,
+		`title =`,
+		`title = "unterminated`,
+		`color = "red"`,
+		`title < "a"`,
+		`published ~ "2020"`,
+		`published > -7y`,
+		`published > "yesterday"`,
+		`title ~ "(unbalanced"`,
+		`(title = "a"`,
+		`title = "a" AND`,
+		`title = "a" title = "b"`,
+		`NOT`,
+		`"title" = "a"`,
+		`title = (`,
+	} {
+		expr, parseerr := Parse_filter(s)
+		if parseerr == nil { t.Errorf("Parse_filter(%q) = %q, want an error", s, expr.String()) }
+	}
+
+	for _, data := range []string{`{"op":"and","args":[{"op":"=","field":"title","value":"a"}]}`, `{"op":"not"}`, `{"op":"~","field":"title","value":"("}`} {
+		_, loaderr := Load_filter(data)
+		if loaderr == nil { t.Errorf("Load_filter(%s) succeeded, want an error", data) }
+	}
+}
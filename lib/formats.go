@@ -0,0 +1,47 @@
+package lib
+
+// Output formats of compilations. The RSS output is written to the
+// compilation's `filename`, other formats next to it with their own extension.
+
+import "path"
+import "strings"
+
+// In the order they are written
+var OutputFormats = []string{"rss", "atom", "json"}
+
+var format_extensions = map[string]string{"rss": ".rss", "atom": ".atom", "json": ".json"}
+
+func Valid_format (format string) (bool) {
+	_, ok := format_extensions[format]
+	return ok
+}
+
+// Returns the formats stored in `compilation.formats`, RSS if none are set
+func Parse_formats (s string) ([]string) {
+	var result []string
+	for _, format := range strings.Split(s, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if Valid_format(format) && !contains_string(result, format) { result = append(result, format) }
+	}
+
+	if len(result) == 0 { return []string{"rss"} }
+	return result
+}
+
+func Format_extension (format string) (string) {
+	return format_extensions[format]
+}
+
+// Returns the file name or URL of the output in `format`, based on the one
+// configured for the compilation. Works for both paths and URLs.
+func Format_path (p string, format string) (string) {
+	if p == "" || format == "rss" { return p }
+	return strings.TrimSuffix(p, path.Ext(p))+Format_extension(format)
+}
+
+func contains_string (list []string, s string) (bool) {
+	for _, item := range list {
+		if item == s { return true }
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package lib
 
 // all function names need to start with a capital letter to be exported
 
+import "net/url"
 import "os"
 import "strings"
 
@@ -22,6 +23,24 @@ func Value_or_default (value interface{}, def interface{}) (interface{}) {
 	return nil
 }
 
+// Splits a URL into schema and URN the way the catalogue stores them. The schema
+// may be omitted by users, so http is added by default, fetcher follows redirects
+// to HTTPS later. The query is kept, as it often selects the document (format,
+// paging, API keys). Used by api when adding feeds and fetcher when moving them.
+func Normalize_url (s string) (string, string, error) {
+	if strings.ToLower(FirstN(s,4)) != "http" {
+		s = "http://" + s
+	}
+
+	u, err := url.ParseRequestURI(s)
+	if err != nil { return "", "", err }
+
+	urn := strings.ToLower(u.Host)+u.Path
+	if u.RawQuery != "" { urn += "?"+u.RawQuery }
+
+	return strings.ToLower(u.Scheme), urn, nil
+}
+
 func Maxlen (s string, n int) string {
 	if len(s) > n {
 		return s[:n]
@@ -62,6 +81,7 @@ func LoadConfig (component string) (*koanf.Koanf) {
 	k.Set("configfile", "<none>")
 	k.Set("database.type", "sqlite3")
 	k.Set("database.url", "rssmix.sql")
+	k.Set("storage.type", "filesystem")
 
 	// Component specific defaults
 	switch component {
@@ -72,14 +92,44 @@ func LoadConfig (component string) (*koanf.Koanf) {
 		k.Set("public.protocol", "https")
 		k.Set("public.hostname", "localhost")
 		k.Set("public.subdirs", 0)
+		k.Set("discovery.timeout", 10)
+		k.Set("refresh.ratelimit", 300)
+		k.Set("gc.minage", 60)
+		k.Set("websub.maxlease", 864000)
+		k.Set("mirror.enabled", false)
+		k.Set("mirror.maxquota", 0)
 	case "compiler":
-		// none
+		k.Set("metrics.listen", "127.0.0.1:9812")
+		k.Set("refresh.poll", 10)
+		k.Set("refresh.attempts", 3)
+		k.Set("gc.interval", 0)
+		k.Set("gc.minage", 60)
 	case "fetcher":
 		k.Set("interval", 10)
 		k.Set("workdir", os.Getenv("HOME"))
 		k.Set("subdirs", 0)
+		k.Set("workers", 10)
+		k.Set("backoff.base", 5)
+		k.Set("backoff.max", 1440)
+		k.Set("download.maxsize", 10485760)
+		k.Set("failures.max", 10)
+		k.Set("failures.maxage", 72)
+		k.Set("failures.reprobe", 24)
+		k.Set("redirects.threshold", 3)
+		k.Set("refresh.poll", 10)
+		k.Set("websub.lease", 864000)
+		k.Set("websub.poll", 1440)
+		k.Set("host.concurrency", 2)
+		k.Set("host.delay", 1000)
+		k.Set("schedule.min", 10)
+		k.Set("schedule.max", 1440)
+		k.Set("metrics.listen", "127.0.0.1:9811")
+		k.Set("mirror.maxsize", 200)
+		k.Set("mirror.quota", 1024)
+		k.Set("mirror.retention", 30)
+		k.Set("mirror.timeout", 600)
 	case "publisher":
-		// none
+		k.Set("metrics.listen", "127.0.0.1:9813")
 	}
 
 	// Try config files
@@ -0,0 +1,223 @@
+package lib
+
+// Garbage collection of data left behind by removed feeds and compilations.
+// Used by `api` on demand and by `compiler` periodically.
+
+import "database/sql"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "regexp"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+import "github.com/knadh/koanf"
+
+type GCReport struct {
+	DryRun		bool		`json:"dry_run"`
+	FeedStatus	int64		`json:"feed_status"`
+	Websub		int64		`json:"websub"`
+	Enclosures	int64		`json:"enclosures"`
+	CplStatus	int64		`json:"compilation_status"`
+	Files		[]string	`json:"files"`
+	Outputs		[]string	`json:"outputs"`
+	Bytes		int64		`json:"bytes"`
+	Errors		[]string	`json:"errors,omitempty"`
+}
+
+// Keys of stored feeds and enclosures as written by `fetcher`: a SHA-256 hash,
+// optionally below `subdirs` directories named after its first characters.
+// Enclosures live in `enclosures/` and may carry an extension.
+var stored_key = regexp.MustCompile(`^(enclosures/)?((?:[0-9a-f]/)*)([0-9a-f]{64})(\.[a-z0-9]{1,8})?$`)
+
+// Filesystem storage falls back to the home directory, which must never be
+// garbage collected, so the storage path has to be set explicitly
+func Check_gc_config (k *koanf.Koanf) (error) {
+	if (k.String("storage.type") == "" || k.String("storage.type") == "filesystem") && k.String("storage.path") == "" {
+		return errors.New("Garbage collection needs `storage.path` to be set")
+	}
+	return nil
+}
+
+// Removes compilation `cplid` within `tx`. Its outputs are recorded in
+// `compilation_removed`, for garbage collection to remove them later.
+func Remove_compilation (tx *sql.Tx, cplid string) (error) {
+	var filename string
+	var formats string
+	qrerr := tx.QueryRow("SELECT COALESCE(filename,''), COALESCE(formats,'') FROM compilation WHERE id = ?", cplid).Scan(&filename, &formats)
+	if qrerr != nil { return qrerr }
+
+	if filename != "" {
+		_, execerr := tx.Exec("INSERT INTO compilation_removed (filename, formats, removed) VALUES (?, ?, ?)", filename, formats, time.Now().Unix())
+		if execerr != nil { return execerr }
+	}
+
+	for _, table := range []string{"compilation_content", "compilation_status", "compilation"} {
+		_, execerr := tx.Exec("DELETE FROM "+table+" WHERE id = ?", cplid)
+		if execerr != nil { return execerr }
+	}
+	return nil
+}
+
+// Removes `feed_status`, `websub` and `enclosure` rows without a feed,
+// `compilation_status` rows without a compilation, stored feeds and enclosures
+// nothing refers to and the outputs of removed compilations. Only keys in the
+// layout `fetcher` writes are considered, anything else in storage is left alone.
+// Anything modified within `minage` is kept, as it may just be in the process of
+// being added. With `dryrun` nothing is removed, but the report is the same.
+func Collect_garbage (db *sqlx.DB, storage Storage, minage time.Duration, dryrun bool) (GCReport, error) {
+	var report GCReport
+	report.DryRun = dryrun
+	report.Files = []string{}
+	report.Outputs = []string{}
+
+	// Orphaned rows
+	orphans := []struct {
+		table		string
+		where		string
+		count		*int64
+	}{
+		{"feed_status", "id NOT IN (SELECT id FROM feed)", &report.FeedStatus},
+		{"websub", "id NOT IN (SELECT id FROM feed)", &report.Websub},
+		{"enclosure", "feed_id NOT IN (SELECT id FROM feed)", &report.Enclosures},
+		{"compilation_status", "id NOT IN (SELECT id FROM compilation)", &report.CplStatus},
+	}
+	for _, orphan := range orphans {
+		if dryrun {
+			scanerr := db.QueryRow("SELECT COUNT(*) FROM "+orphan.table+" WHERE "+orphan.where).Scan(orphan.count)
+			if scanerr != nil { return report, scanerr }
+		} else {
+			result, execerr := db.Exec("DELETE FROM "+orphan.table+" WHERE "+orphan.where)
+			if execerr != nil { return report, execerr }
+			*orphan.count, _ = result.RowsAffected()
+		}
+	}
+
+	// Stored feeds
+	referenced, referr := referenced_files(db, "SELECT COALESCE(filename,'') FROM feed UNION SELECT COALESCE(filename,'') FROM enclosure")
+	if referr != nil { return report, referr }
+	if fs, ok := storage.(*FileStorage); ok {
+		// Older rows contain absolute paths
+		for name := range referenced {
+			if !filepath.IsAbs(name) { continue }
+			rel, relerr := filepath.Rel(fs.Root, name)
+			if relerr == nil { referenced[rel] = true }
+		}
+	}
+
+	objects, listerr := storage.List()
+	if listerr != nil { return report, listerr }
+	for _, object := range objects {
+		if !is_stored_key(object.Key) || referenced[object.Key] || time.Since(object.Modified) < minage { continue }
+
+		if !dryrun {
+			delerr := storage.Delete(object.Key)
+			if delerr != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", object.Key, delerr))
+				continue
+			}
+		}
+		report.Files = append(report.Files, object.Key)
+		report.Bytes += object.Size
+	}
+
+	outputerr := collect_outputs(db, &report, minage, dryrun)
+	return report, outputerr
+}
+
+// Removes the outputs of removed compilations, unless another compilation
+// writes to the same file by now. Once all of them are gone, so is the record.
+func collect_outputs (db *sqlx.DB, report *GCReport, minage time.Duration, dryrun bool) (error) {
+	var removed []struct {
+		Filename	string
+		Formats		string
+	}
+	selecterr := db.Select(&removed, "SELECT DISTINCT COALESCE(filename,'') AS filename, COALESCE(formats,'') AS formats FROM compilation_removed")
+	if selecterr != nil { return selecterr }
+	if len(removed) == 0 { return nil }
+
+	var current []struct {
+		Filename	string
+		Formats		string
+	}
+	selecterr = db.Select(&current, "SELECT COALESCE(filename,'') AS filename, COALESCE(formats,'') AS formats FROM compilation")
+	if selecterr != nil { return selecterr }
+	outputs := make(map[string]bool)
+	for _, compilation := range current {
+		for _, format := range OutputFormats {
+			if compilation.Filename != "" { outputs[filepath.Clean(Format_path(compilation.Filename, format))] = true }
+		}
+	}
+
+	for _, compilation := range removed {
+		done := true
+		for _, format := range Parse_formats(compilation.Formats) {
+			file := Format_path(compilation.Filename, format)
+			if file == "" || outputs[filepath.Clean(file)] { continue }
+
+			info, staterr := os.Stat(file)
+			if os.IsNotExist(staterr) { continue }
+			if staterr != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", file, staterr))
+				done = false
+				continue
+			}
+			// Written just before the compilation was removed, retried next time
+			if time.Since(info.ModTime()) < minage {
+				done = false
+				continue
+			}
+
+			if !dryrun {
+				rmerr := os.Remove(file)
+				if rmerr != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", file, rmerr))
+					done = false
+					continue
+				}
+			}
+			report.Outputs = append(report.Outputs, file)
+			report.Bytes += info.Size()
+		}
+
+		if done && !dryrun {
+			_, execerr := db.Exec("DELETE FROM compilation_removed WHERE filename = ? AND formats = ?", compilation.Filename, compilation.Formats)
+			if execerr != nil { return execerr }
+		}
+	}
+
+	return nil
+}
+
+// Whether `key` is a stored feed or enclosure, see `stored_key`
+func is_stored_key (key string) (bool) {
+	m := stored_key.FindStringSubmatch(filepath.ToSlash(key))
+	if m == nil { return false }
+	// Only enclosures have extensions
+	if m[1] == "" && m[4] != "" { return false }
+
+	// Directories are the first characters of the hash
+	dirs := m[2]
+	for i := 0; i < len(dirs)/2; i++ {
+		if dirs[i*2] != m[3][i] { return false }
+	}
+	return true
+}
+
+func referenced_files (db *sqlx.DB, query string) (map[string]bool, error) {
+	result := make(map[string]bool)
+
+	rows, qerr := db.Query(query)
+	if qerr != nil { return result, qerr }
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		scanerr := rows.Scan(&name)
+		if scanerr != nil { return result, scanerr }
+		if name != "" { result[filepath.Clean(name)] = true }
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,80 @@
+package lib
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+import _ "github.com/mattn/go-sqlite3"
+import "github.com/jmoiron/sqlx"
+
+// Opens a database with the schema in `sql/sqlite3.txt`
+func test_database (t *testing.T, dir string) (*sqlx.DB) {
+	schema, readerr := ioutil.ReadFile("../sql/sqlite3.txt")
+	if readerr != nil { t.Fatal(readerr) }
+
+	db, openerr := sqlx.Open("sqlite3", filepath.Join(dir, "rssmix.sql"))
+	if openerr != nil { t.Fatal(openerr) }
+	_, execerr := db.Exec(string(schema))
+	if execerr != nil { t.Fatal(execerr) }
+	return db
+}
+
+func TestRemoveCompilation (t *testing.T) {
+	dir, direrr := ioutil.TempDir("", "rssmix")
+	if direrr != nil { t.Fatal(direrr) }
+	defer os.RemoveAll(dir)
+
+	db := test_database(t, dir)
+	defer db.Close()
+	storage := &FileStorage{Root: filepath.Join(dir, "storage")}
+	os.Mkdir(storage.Root, 0755)
+
+	output := func(name string) (string) { return filepath.Join(dir, name) }
+	for _, cpl := range [][]string{{"a", "a.rss", "rss,atom"}, {"b", "b.rss", "rss"}} {
+		db.MustExec("INSERT INTO compilation (id, filename, formats) VALUES (?, ?, ?)", cpl[0], output(cpl[1]), cpl[2])
+		db.MustExec("INSERT INTO compilation_status (id, updated, published) VALUES (?, 1, 1)", cpl[0])
+	}
+	// Left behind by compilations deleted before
+	db.MustExec("INSERT INTO compilation_status (id, updated, published) VALUES ('c', 1, 1)")
+	for _, name := range []string{"a.rss", "a.atom", "a.json", "b.rss"} {
+		writeerr := ioutil.WriteFile(output(name), []byte("output of "+name), 0644)
+		if writeerr != nil { t.Fatal(writeerr) }
+	}
+
+	tx, txerr := db.Begin()
+	if txerr != nil { t.Fatal(txerr) }
+	removeerr := Remove_compilation(tx, "a")
+	if removeerr != nil { t.Fatal(removeerr) }
+	if commiterr := tx.Commit(); commiterr != nil { t.Fatal(commiterr) }
+
+	var compilations int
+	db.Get(&compilations, "SELECT COUNT(*) FROM compilation WHERE id = 'a'")
+	if compilations != 0 { t.Errorf("Compilation is still there") }
+
+	// A dry run reports, but keeps everything
+	report, gcerr := Collect_garbage(db, storage, 0, true)
+	if gcerr != nil { t.Fatal(gcerr) }
+	if len(report.Outputs) != 2 || report.Bytes != int64(len("output of a.rss") + len("output of a.atom")) {
+		t.Errorf("Dry run reports %q, %d bytes", report.Outputs, report.Bytes)
+	}
+	if report.CplStatus != 1 { t.Errorf("Dry run reports %d orphaned compilation_status rows, want 1", report.CplStatus) }
+	if !File_exists(output("a.rss")) { t.Errorf("Dry run removed %s", output("a.rss")) }
+
+	report, gcerr = Collect_garbage(db, storage, 0, false)
+	if gcerr != nil { t.Fatal(gcerr) }
+	if len(report.Outputs) != 2 || len(report.Errors) > 0 { t.Errorf("Removed %q, errors %q", report.Outputs, report.Errors) }
+	for _, name := range []string{"a.rss", "a.atom"} {
+		if File_exists(output(name)) { t.Errorf("Output %s of the deleted compilation is still there", name) }
+	}
+	// Not an output of a, and the output of b
+	for _, name := range []string{"a.json", "b.rss"} {
+		if !File_exists(output(name)) { t.Errorf("%s was removed", name) }
+	}
+
+	var rows int
+	db.Get(&rows, "SELECT COUNT(*) FROM compilation_status WHERE id != 'b'")
+	if rows != 0 { t.Errorf("%d compilation_status rows without a compilation are left", rows) }
+	db.Get(&rows, "SELECT COUNT(*) FROM compilation_removed")
+	if rows != 0 { t.Errorf("%d compilation_removed rows are left", rows) }
+}
@@ -0,0 +1,145 @@
+package lib
+
+// A small subset of JSONPath, enough to map API responses to feed items:
+// $ (or @) as root, .name, ['name'], [n], [-n], [*], .* and ..name
+
+import "errors"
+import "fmt"
+import "strconv"
+import "strings"
+
+type pathstep struct {
+	Key		string
+	Index		int
+	IsIndex		bool
+	Wildcard	bool
+	Recursive	bool
+}
+
+// Returns all values matching `path` in a document decoded by encoding/json
+func Jsonpath (doc interface{}, path string) ([]interface{}, error) {
+	steps, parseerr := parse_jsonpath(path)
+	if parseerr != nil { return nil, parseerr }
+
+	nodes := []interface{}{doc}
+	for _, step := range steps {
+		var next []interface{}
+		for _, node := range nodes {
+			if step.Recursive {
+				for _, descendant := range descendants(node) {
+					next = append(next, apply_step(descendant, step)...)
+				}
+			} else {
+				next = append(next, apply_step(node, step)...)
+			}
+		}
+		nodes = next
+	}
+
+	return nodes, nil
+}
+
+func parse_jsonpath (path string) ([]pathstep, error) {
+	var steps []pathstep
+
+	path = strings.TrimSpace(path)
+	if path == "" { return nil, errors.New("Empty JSONPath") }
+	if path[0] == '$' || path[0] == '@' {
+		path = path[1:]
+	} else if path[0] != '.' && path[0] != '[' {
+		// Bare names are relative to the root
+		path = "." + path
+	}
+
+	recursive := false
+	for len(path) > 0 {
+		var step pathstep
+		switch {
+		case strings.HasPrefix(path, ".."):
+			// Applies to the step which follows
+			recursive = true
+			path = path[2:]
+			if !strings.HasPrefix(path, "[") { path = "." + path }
+			continue
+		case path[0] == '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end < 0 { end = len(path) }
+			name := path[:end]
+			path = path[end:]
+			if name == "" { return nil, errors.New("Empty name in JSONPath") }
+			if name == "*" {
+				step.Wildcard = true
+			} else {
+				step.Key = name
+			}
+		case path[0] == '[':
+			end := strings.Index(path, "]")
+			if end < 0 { return nil, errors.New("Unterminated [ in JSONPath") }
+			inner := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+			switch {
+			case inner == "*":
+				step.Wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.Key = inner[1:len(inner)-1]
+			default:
+				index, converr := strconv.Atoi(inner)
+				if converr != nil { return nil, fmt.Errorf("Unsupported JSONPath expression [%s]", inner) }
+				step.Index = index
+				step.IsIndex = true
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected %q in JSONPath", path[0])
+		}
+
+		step.Recursive = recursive
+		recursive = false
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func apply_step (node interface{}, step pathstep) ([]interface{}) {
+	var result []interface{}
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if step.Wildcard {
+			for _, child := range value {
+				result = append(result, child)
+			}
+		} else if child, ok := value[step.Key]; ok && !step.IsIndex {
+			result = append(result, child)
+		}
+	case []interface{}:
+		if step.Wildcard {
+			result = append(result, value...)
+		} else if step.IsIndex {
+			index := step.Index
+			if index < 0 { index += len(value) }
+			if index >= 0 && index < len(value) { result = append(result, value[index]) }
+		}
+	}
+
+	return result
+}
+
+// Returns a node and everything below it
+func descendants (node interface{}) ([]interface{}) {
+	result := []interface{}{node}
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for _, child := range value {
+			result = append(result, descendants(child)...)
+		}
+	case []interface{}:
+		for _, child := range value {
+			result = append(result, descendants(child)...)
+		}
+	}
+
+	return result
+}
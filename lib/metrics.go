@@ -0,0 +1,224 @@
+package lib
+
+// Minimal Prometheus metrics: counters, gauges and histograms with labels,
+// exposed in the text format at `/metrics`
+
+import "bufio"
+import "fmt"
+import "io"
+import "log"
+import "math"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+type metric interface {
+	write (w io.Writer)
+}
+
+var registry struct {
+	mutex		sync.Mutex
+	metrics		[]metric
+}
+
+// Buckets (in seconds) for request and fetch latencies
+var LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func register (m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+type Counter struct {
+	name		string
+	help		string
+	labels		[]string
+	mutex		sync.Mutex
+	values		map[string]float64
+}
+
+func NewCounter (name string, help string, labels ...string) (*Counter) {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Label values are passed in the order the labels were declared
+func (c *Counter) Inc (values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add (v float64, values ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[label_set(c.labels, values, "")] += v
+}
+
+func (c *Counter) write (w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sorted_keys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, format_value(c.values[labels]))
+	}
+}
+
+type Gauge struct {
+	name		string
+	help		string
+	labels		[]string
+	mutex		sync.Mutex
+	values		map[string]float64
+}
+
+func NewGauge (name string, help string, labels ...string) (*Gauge) {
+	g := &Gauge{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set (v float64, values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[label_set(g.labels, values, "")] = v
+}
+
+func (g *Gauge) write (w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, labels := range sorted_keys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, format_value(g.values[labels]))
+	}
+}
+
+type Histogram struct {
+	name		string
+	help		string
+	labels		[]string
+	buckets		[]float64
+	mutex		sync.Mutex
+	series		map[string]*histogram_series
+}
+
+type histogram_series struct {
+	values		[]string
+	counts		[]uint64
+	sum		float64
+	count		uint64
+}
+
+func NewHistogram (name string, help string, buckets []float64, labels ...string) (*Histogram) {
+	sort.Float64s(buckets)
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram_series)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe (v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := strings.Join(values, "\x00")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram_series{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound { series.counts[i]++ }
+	}
+	series.sum += v
+	series.count++
+}
+
+func (h *Histogram) write (w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var keys []string
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		// Bucket counts are cumulative already
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, label_set(h.labels, series.values, format_value(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, label_set(h.labels, series.values, "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, label_set(h.labels, series.values, ""), format_value(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, label_set(h.labels, series.values, ""), series.count)
+	}
+}
+
+// Returns `{label="value",...}`, including `le` for histogram buckets
+func label_set (labels []string, values []string, le string) (string) {
+	var pairs []string
+	for i, label := range labels {
+		value := ""
+		if i < len(values) { value = values[i] }
+		pairs = append(pairs, label+"=\""+escape_label(value)+"\"")
+	}
+	if le != "" { pairs = append(pairs, "le=\""+le+"\"") }
+
+	if len(pairs) == 0 { return "" }
+	return "{"+strings.Join(pairs, ",")+"}"
+}
+
+func escape_label (s string) (string) {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return strings.Replace(s, "\n", "\\n", -1)
+}
+
+func format_value (v float64) (string) {
+	if math.IsInf(v, 1) { return "+Inf" }
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sorted_keys (m map[string]float64) ([]string) {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writes all registered metrics in the Prometheus text format
+func Write_metrics (w io.Writer) (error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range registry.metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Serves `/metrics` on `address`, for components without an HTTP server of their own
+func Serve_metrics (address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		werr := Write_metrics(w)
+		if werr != nil { log.Printf("Writing metrics failed: %s\n", werr) }
+	})
+
+	go func() {
+		log.Printf("Serving metrics on %s\n", address)
+		listenerr := http.ListenAndServe(address, mux)
+		log.Printf("Metrics listener failed: %s\n", listenerr)
+	}()
+}
@@ -0,0 +1,129 @@
+package lib
+
+// Keeps user-submitted URLs from reaching internal services.
+// Addresses are checked when connecting, after DNS resolution, so every
+// redirect and every address a name resolves to is covered.
+
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "syscall"
+import "time"
+
+import "github.com/knadh/koanf"
+
+// Loopback, link-local, private, shared, multicast and reserved ranges
+var default_blocked = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+			       "169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+			       "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+			       "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8"}
+
+// NAT64 (well-known prefix) addresses end with the IPv4 address they reach
+var nat64_prefix = net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+type AddressGuard struct {
+	blocked		[]*net.IPNet
+	allowed		[]*net.IPNet
+}
+
+type BlockedAddressError struct {
+	IP		net.IP
+}
+
+func (e *BlockedAddressError) Error () (string) {
+	return fmt.Sprintf("Address %s is not allowed (SSRF protection)", e.IP)
+}
+
+func IsBlockedAddress (err error) (bool) {
+	var blocked *BlockedAddressError
+	return errors.As(err, &blocked)
+}
+
+// Builds a guard from the default ranges plus `ssrf.block`,
+// `ssrf.allow` takes precedence over both
+func NewAddressGuard (k *koanf.Koanf) (*AddressGuard, error) {
+	var guard AddressGuard
+	var parseerr error
+
+	guard.blocked, parseerr = parse_cidrs(append(default_blocked, k.Strings("ssrf.block")...))
+	if parseerr != nil { return nil, parseerr }
+	guard.allowed, parseerr = parse_cidrs(k.Strings("ssrf.allow"))
+	if parseerr != nil { return nil, parseerr }
+
+	return &guard, nil
+}
+
+func parse_cidrs (list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range list {
+		_, network, cidrerr := net.ParseCIDR(cidr)
+		if cidrerr != nil { return nil, fmt.Errorf("Invalid CIDR %q: %s", cidr, cidrerr) }
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func (g *AddressGuard) Permitted (ip net.IP) (bool) {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil { ip = ip4 }
+	// IPv4 addresses embedded in NAT64 and 6to4 addresses must be permitted as well
+	if embedded := embedded_ipv4(ip); embedded != nil && !g.Permitted(embedded) { return false }
+
+	for _, network := range g.allowed {
+		if network.Contains(ip) { return true }
+	}
+	for _, network := range g.blocked {
+		if network.Contains(ip) { return false }
+	}
+	return true
+}
+
+// Returns the IPv4 address embedded in a NAT64 or 6to4 (2002::/16) address
+func embedded_ipv4 (ip net.IP) (net.IP) {
+	if len(ip) != net.IPv6len { return nil }
+	if nat64_prefix.Contains(ip) { return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4() }
+	if ip[0] == 0x20 && ip[1] == 0x02 { return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4() }
+	return nil
+}
+
+// Resolves `host` and checks all of its addresses, for URLs which are
+// only stored now and retrieved later
+func (g *AddressGuard) Check_host (host string) (error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.Permitted(ip) { return &BlockedAddressError{IP: ip} }
+		return nil
+	}
+
+	addrs, lookuperr := net.LookupIP(host)
+	// Unresolvable names are not our concern here
+	if lookuperr != nil { return nil }
+	for _, ip := range addrs {
+		if !g.Permitted(ip) { return &BlockedAddressError{IP: ip} }
+	}
+	return nil
+}
+
+// Used as `net.Dialer.Control`, which sees the resolved address of every connection
+func (g *AddressGuard) control (network string, address string, c syscall.RawConn) (error) {
+	host, _, spliterr := net.SplitHostPort(address)
+	if spliterr != nil { return spliterr }
+
+	ip := net.ParseIP(host)
+	if ip == nil { return fmt.Errorf("Not an IP address: %s", host) }
+	if !g.Permitted(ip) { return &BlockedAddressError{IP: ip} }
+	return nil
+}
+
+// Returns a copy of `http.DefaultTransport` which only connects to permitted addresses.
+// Proxies are not used, as the guard could only check the proxy's address.
+func (g *AddressGuard) Transport () (*http.Transport) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second,
+			      KeepAlive: 30 * time.Second,
+			      Control: g.control}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
@@ -0,0 +1,456 @@
+package lib
+
+// Compiled feeds and their writers. gorilla/feeds has no room for several
+// authors, categories, media and iTunes metadata or source attribution,
+// so compiler keeps items in these types and writes them itself.
+
+import "encoding/json"
+import "encoding/xml"
+import "io"
+import "strconv"
+import "time"
+
+import ext "github.com/mmcdole/gofeed/extensions"
+
+type CompiledFeed struct {
+	Title		string
+	Link		string
+	Description	string
+	Created		time.Time
+	Items		[]*CompiledItem
+	// Only written to RSS, nil unless podcast mode is enabled
+	Podcast		*Podcast
+}
+
+type CompiledItem struct {
+	Id		string
+	Title		string
+	Link		string
+	Description	string
+	Content		string
+	Created		time.Time
+	Updated		time.Time
+	Authors		[]ItemAuthor
+	Categories	[]string
+	Enclosures	[]ItemEnclosure
+	Media		[]ItemMedia
+	Thumbnail	string
+	Comments	string
+	ITunes		*ext.ITunesItemExtension
+	Origin		ItemOrigin
+}
+
+type ItemAuthor struct {
+	Name		string
+	Email		string
+}
+
+type ItemEnclosure struct {
+	Url		string
+	Type		string
+	Length		int64
+}
+
+// `media:content` elements
+type ItemMedia struct {
+	Url		string
+	Type		string
+	Medium		string
+	Width		string
+	Height		string
+}
+
+// The feed an item was taken from
+type ItemOrigin struct {
+	Title		string
+	Url		string
+}
+
+// Namespaces of the elements written besides plain RSS and Atom
+const (
+	ns_atom		= "http://www.w3.org/2005/Atom"
+	ns_content	= "http://purl.org/rss/1.0/modules/content/"
+	ns_dc		= "http://purl.org/dc/elements/1.1/"
+	ns_itunes	= "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	ns_media	= "http://search.yahoo.com/mrss/"
+)
+
+type xml_cdata struct {
+	Text		string		`xml:",cdata"`
+}
+
+type xml_link struct {
+	Href		string		`xml:"href,attr"`
+	Rel		string		`xml:"rel,attr,omitempty"`
+	Type		string		`xml:"type,attr,omitempty"`
+	Length		string		`xml:"length,attr,omitempty"`
+	Title		string		`xml:"title,attr,omitempty"`
+}
+
+type xml_media struct {
+	Url		string		`xml:"url,attr"`
+	Type		string		`xml:"type,attr,omitempty"`
+	Medium		string		`xml:"medium,attr,omitempty"`
+	Width		string		`xml:"width,attr,omitempty"`
+	Height		string		`xml:"height,attr,omitempty"`
+	FileSize	string		`xml:"fileSize,attr,omitempty"`
+}
+
+type xml_thumbnail struct {
+	Url		string		`xml:"url,attr"`
+}
+
+type xml_itunes_image struct {
+	Href		string		`xml:"href,attr"`
+}
+
+// Item level iTunes elements, shared by RSS and Atom
+type xml_itunes_item struct {
+	Author		string		`xml:"itunes:author,omitempty"`
+	Duration	string		`xml:"itunes:duration,omitempty"`
+	Image		*xml_itunes_image	`xml:"itunes:image"`
+	Episode		string		`xml:"itunes:episode,omitempty"`
+	Season		string		`xml:"itunes:season,omitempty"`
+	EpisodeType	string		`xml:"itunes:episodeType,omitempty"`
+	Explicit	string		`xml:"itunes:explicit,omitempty"`
+	Subtitle	string		`xml:"itunes:subtitle,omitempty"`
+	Summary		string		`xml:"itunes:summary,omitempty"`
+	Keywords	string		`xml:"itunes:keywords,omitempty"`
+	Block		string		`xml:"itunes:block,omitempty"`
+	Closed		string		`xml:"itunes:isClosedCaptioned,omitempty"`
+	Order		string		`xml:"itunes:order,omitempty"`
+}
+
+type rss_doc struct {
+	XMLName		xml.Name	`xml:"rss"`
+	Version		string		`xml:"version,attr"`
+	NsAtom		string		`xml:"xmlns:atom,attr"`
+	NsContent	string		`xml:"xmlns:content,attr"`
+	NsDc		string		`xml:"xmlns:dc,attr"`
+	NsItunes	string		`xml:"xmlns:itunes,attr"`
+	NsMedia		string		`xml:"xmlns:media,attr"`
+	NsPodcast	string		`xml:"xmlns:podcast,attr,omitempty"`
+	Channel		rss_channel	`xml:"channel"`
+}
+
+type rss_channel struct {
+	Title		string		`xml:"title"`
+	Link		string		`xml:"link"`
+	Description	string		`xml:"description"`
+	LastBuildDate	string		`xml:"lastBuildDate"`
+	Self		*xml_link	`xml:"atom:link"`
+	xml_podcast_channel
+	Items		[]rss_item	`xml:"item"`
+}
+
+type rss_item struct {
+	Title		string		`xml:"title,omitempty"`
+	Link		string		`xml:"link,omitempty"`
+	Description	*xml_cdata	`xml:"description"`
+	Content		*xml_cdata	`xml:"content:encoded"`
+	Author		string		`xml:"author,omitempty"`
+	Creators	[]string	`xml:"dc:creator"`
+	Categories	[]string	`xml:"category"`
+	Comments	string		`xml:"comments,omitempty"`
+	Enclosure	*rss_enclosure	`xml:"enclosure"`
+	Guid		*rss_guid	`xml:"guid"`
+	PubDate		string		`xml:"pubDate,omitempty"`
+	Source		*rss_source	`xml:"source"`
+	Media		[]xml_media	`xml:"media:content"`
+	Thumbnail	*xml_thumbnail	`xml:"media:thumbnail"`
+	xml_itunes_item
+}
+
+type rss_enclosure struct {
+	Url		string		`xml:"url,attr"`
+	Length		string		`xml:"length,attr"`
+	Type		string		`xml:"type,attr"`
+}
+
+type rss_guid struct {
+	Value		string		`xml:",chardata"`
+	IsPermaLink	string		`xml:"isPermaLink,attr"`
+}
+
+type rss_source struct {
+	Url		string		`xml:"url,attr"`
+	Title		string		`xml:",chardata"`
+}
+
+// Writes RSS 2.0, `feedurl` is where the output itself will be published
+func Write_rss (w io.Writer, feed *CompiledFeed, feedurl string) (error) {
+	doc := rss_doc{Version: "2.0", NsAtom: ns_atom, NsContent: ns_content, NsDc: ns_dc, NsItunes: ns_itunes, NsMedia: ns_media}
+	doc.Channel = rss_channel{Title: feed.Title,
+				  Link: feed.Link,
+				  Description: feed.Description,
+				  LastBuildDate: feed.Created.Format(time.RFC1123Z)}
+	// Description is required
+	if doc.Channel.Description == "" { doc.Channel.Description = feed.Title }
+	if feedurl != "" { doc.Channel.Self = &xml_link{Href: feedurl, Rel: "self", Type: "application/rss+xml"} }
+	if feed.Podcast != nil {
+		doc.NsPodcast = ns_podcast
+		doc.Channel.xml_podcast_channel = podcast_elements(feed.Podcast, feed, feedurl)
+		if feed.Podcast.Summary != "" && feed.Description == "" { doc.Channel.Description = feed.Podcast.Summary }
+	}
+
+	for _, item := range feed.Items {
+		out := rss_item{Title: item.Title,
+				Link: item.Link,
+				Categories: item.Categories,
+				Comments: item.Comments,
+				Media: media_elements(item),
+				xml_itunes_item: itunes_elements(item.ITunes)}
+
+		if item.Description != "" { out.Description = &xml_cdata{item.Description} }
+		if item.Content != "" { out.Content = &xml_cdata{item.Content} }
+		if !item.Created.IsZero() { out.PubDate = item.Created.Format(time.RFC1123Z) }
+		if item.Thumbnail != "" { out.Thumbnail = &xml_thumbnail{Url: item.Thumbnail} }
+		// Podcast apps only show episode artwork from itunes:image
+		if feed.Podcast != nil && out.Image == nil && item.Thumbnail != "" { out.Image = &xml_itunes_image{Href: item.Thumbnail} }
+
+		// <author> has to be an email address, names go into dc:creator
+		for _, author := range item.Authors {
+			if author.Email != "" && out.Author == "" {
+				out.Author = author.Email
+				if author.Name != "" { out.Author += " ("+author.Name+")" }
+			}
+			if author.Name != "" { out.Creators = append(out.Creators, author.Name) }
+		}
+
+		// RSS allows one enclosure, the others become media:content
+		if len(item.Enclosures) > 0 {
+			first := item.Enclosures[0]
+			out.Enclosure = &rss_enclosure{Url: first.Url, Length: strconv.FormatInt(first.Length, 10), Type: first.Type}
+		}
+
+		if item.Id != "" {
+			out.Guid = &rss_guid{Value: item.Id, IsPermaLink: "false"}
+			if item.Id == item.Link { out.Guid.IsPermaLink = "true" }
+		}
+
+		if item.Origin.Url != "" { out.Source = &rss_source{Url: item.Origin.Url, Title: item.Origin.Title} }
+
+		doc.Channel.Items = append(doc.Channel.Items, out)
+	}
+
+	return write_xml(w, doc)
+}
+
+type atom_doc struct {
+	XMLName		xml.Name	`xml:"feed"`
+	Ns		string		`xml:"xmlns,attr"`
+	NsItunes	string		`xml:"xmlns:itunes,attr"`
+	NsMedia		string		`xml:"xmlns:media,attr"`
+	Title		string		`xml:"title"`
+	Id		string		`xml:"id"`
+	Updated		string		`xml:"updated"`
+	Subtitle	string		`xml:"subtitle,omitempty"`
+	Links		[]xml_link	`xml:"link"`
+	Entries		[]atom_entry	`xml:"entry"`
+}
+
+type atom_entry struct {
+	Title		string		`xml:"title"`
+	Id		string		`xml:"id"`
+	Updated		string		`xml:"updated"`
+	Published	string		`xml:"published,omitempty"`
+	Links		[]xml_link	`xml:"link"`
+	Authors		[]atom_person	`xml:"author"`
+	Categories	[]atom_category	`xml:"category"`
+	Summary		*atom_text	`xml:"summary"`
+	Content		*atom_text	`xml:"content"`
+	Source		*atom_source	`xml:"source"`
+	Media		[]xml_media	`xml:"media:content"`
+	Thumbnail	*xml_thumbnail	`xml:"media:thumbnail"`
+	xml_itunes_item
+}
+
+type atom_person struct {
+	Name		string		`xml:"name"`
+	Email		string		`xml:"email,omitempty"`
+}
+
+type atom_category struct {
+	Term		string		`xml:"term,attr"`
+}
+
+type atom_text struct {
+	Type		string		`xml:"type,attr"`
+	Text		string		`xml:",chardata"`
+}
+
+type atom_source struct {
+	Title		string		`xml:"title,omitempty"`
+	Id		string		`xml:"id"`
+	Links		[]xml_link	`xml:"link"`
+}
+
+// Writes Atom 1.0, `feedurl` is where the output itself will be published
+func Write_atom (w io.Writer, feed *CompiledFeed, feedurl string) (error) {
+	doc := atom_doc{Ns: ns_atom, NsItunes: ns_itunes, NsMedia: ns_media,
+			Title: feed.Title,
+			Id: feed.Link,
+			Updated: feed.Created.Format(time.RFC3339),
+			Subtitle: feed.Description}
+	if feedurl != "" {
+		doc.Id = feedurl
+		doc.Links = append(doc.Links, xml_link{Href: feedurl, Rel: "self", Type: "application/atom+xml"})
+	}
+	if feed.Link != "" { doc.Links = append(doc.Links, xml_link{Href: feed.Link, Rel: "alternate"}) }
+
+	for _, item := range feed.Items {
+		out := atom_entry{Title: item.Title,
+				  Id: item.Id,
+				  Media: media_elements(item),
+				  xml_itunes_item: itunes_elements(item.ITunes)}
+		if out.Id == "" { out.Id = item.Link }
+
+		updated := item.Updated
+		if updated.IsZero() { updated = item.Created }
+		if updated.IsZero() { updated = feed.Created }
+		out.Updated = updated.Format(time.RFC3339)
+		if !item.Created.IsZero() { out.Published = item.Created.Format(time.RFC3339) }
+
+		if item.Link != "" { out.Links = append(out.Links, xml_link{Href: item.Link, Rel: "alternate"}) }
+		for _, enclosure := range item.Enclosures {
+			out.Links = append(out.Links, xml_link{Href: enclosure.Url, Rel: "enclosure", Type: enclosure.Type, Length: strconv.FormatInt(enclosure.Length, 10)})
+		}
+		if item.Comments != "" { out.Links = append(out.Links, xml_link{Href: item.Comments, Rel: "replies", Type: "text/html"}) }
+
+		for _, author := range item.Authors {
+			if author.Name != "" || author.Email != "" { out.Authors = append(out.Authors, atom_person{Name: author.Name, Email: author.Email}) }
+		}
+		for _, category := range item.Categories {
+			out.Categories = append(out.Categories, atom_category{Term: category})
+		}
+
+		if item.Description != "" { out.Summary = &atom_text{Type: "html", Text: item.Description} }
+		if item.Content != "" { out.Content = &atom_text{Type: "html", Text: item.Content} }
+		if item.Thumbnail != "" { out.Thumbnail = &xml_thumbnail{Url: item.Thumbnail} }
+
+		if item.Origin.Url != "" {
+			out.Source = &atom_source{Title: item.Origin.Title, Id: item.Origin.Url,
+						  Links: []xml_link{{Href: item.Origin.Url, Rel: "self"}}}
+		}
+
+		doc.Entries = append(doc.Entries, out)
+	}
+
+	return write_xml(w, doc)
+}
+
+type jsonfeed_doc struct {
+	Version		string		`json:"version"`
+	Title		string		`json:"title"`
+	HomePageUrl	string		`json:"home_page_url,omitempty"`
+	FeedUrl		string		`json:"feed_url,omitempty"`
+	Description	string		`json:"description,omitempty"`
+	Items		[]jsonfeed_item	`json:"items"`
+}
+
+type jsonfeed_item struct {
+	Id		string		`json:"id"`
+	Url		string		`json:"url,omitempty"`
+	Title		string		`json:"title,omitempty"`
+	ContentHtml	string		`json:"content_html"`
+	Summary		string		`json:"summary,omitempty"`
+	Image		string		`json:"image,omitempty"`
+	Published	string		`json:"date_published,omitempty"`
+	Modified	string		`json:"date_modified,omitempty"`
+	Authors		[]jsonfeed_author	`json:"authors,omitempty"`
+	Tags		[]string	`json:"tags,omitempty"`
+	Attachments	[]jsonfeed_attachment	`json:"attachments,omitempty"`
+}
+
+type jsonfeed_author struct {
+	Name		string		`json:"name"`
+}
+
+type jsonfeed_attachment struct {
+	Url		string		`json:"url"`
+	MimeType	string		`json:"mime_type"`
+	Size		int64		`json:"size_in_bytes,omitempty"`
+}
+
+// Writes JSON Feed 1.1, `feedurl` is where the output itself will be published
+func Write_jsonfeed (w io.Writer, feed *CompiledFeed, feedurl string) (error) {
+	doc := jsonfeed_doc{Version: "https://jsonfeed.org/version/1.1",
+			    Title: feed.Title,
+			    HomePageUrl: feed.Link,
+			    FeedUrl: feedurl,
+			    Description: feed.Description,
+			    Items: []jsonfeed_item{}}
+
+	for _, item := range feed.Items {
+		out := jsonfeed_item{Id: item.Id,
+				     Url: item.Link,
+				     Title: item.Title,
+				     ContentHtml: item.Content,
+				     Summary: item.Description,
+				     Image: item.Thumbnail,
+				     Tags: item.Categories}
+		if out.Id == "" { out.Id = item.Link }
+		// Content is required
+		if out.ContentHtml == "" { out.ContentHtml = item.Description }
+		if !item.Created.IsZero() { out.Published = item.Created.Format(time.RFC3339) }
+		if !item.Updated.IsZero() { out.Modified = item.Updated.Format(time.RFC3339) }
+
+		for _, author := range item.Authors {
+			if author.Name != "" { out.Authors = append(out.Authors, jsonfeed_author{Name: author.Name}) }
+		}
+		for _, enclosure := range item.Enclosures {
+			out.Attachments = append(out.Attachments, jsonfeed_attachment{Url: enclosure.Url, MimeType: enclosure.Type, Size: enclosure.Length})
+		}
+
+		doc.Items = append(doc.Items, out)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// media:content for enclosures besides the first and media found in the original item
+func media_elements (item *CompiledItem) ([]xml_media) {
+	var result []xml_media
+	for i, enclosure := range item.Enclosures {
+		if i == 0 { continue }
+		result = append(result, xml_media{Url: enclosure.Url, Type: enclosure.Type, FileSize: strconv.FormatInt(enclosure.Length, 10)})
+	}
+	for _, media := range item.Media {
+		result = append(result, xml_media{Url: media.Url, Type: media.Type, Medium: media.Medium, Width: media.Width, Height: media.Height})
+	}
+	return result
+}
+
+func itunes_elements (itunes *ext.ITunesItemExtension) (xml_itunes_item) {
+	var result xml_itunes_item
+	if itunes == nil { return result }
+
+	result = xml_itunes_item{Author: itunes.Author,
+				 Duration: itunes.Duration,
+				 Episode: itunes.Episode,
+				 Season: itunes.Season,
+				 EpisodeType: itunes.EpisodeType,
+				 Explicit: itunes.Explicit,
+				 Subtitle: itunes.Subtitle,
+				 Summary: itunes.Summary,
+				 Keywords: itunes.Keywords,
+				 Block: itunes.Block,
+				 Closed: itunes.IsClosedCaptioned,
+				 Order: itunes.Order}
+	if itunes.Image != "" { result.Image = &xml_itunes_image{Href: itunes.Image} }
+	return result
+}
+
+func write_xml (w io.Writer, doc interface{}) (error) {
+	_, werr := io.WriteString(w, xml.Header)
+	if werr != nil { return werr }
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	encodeerr := encoder.Encode(doc)
+	if encodeerr != nil { return encodeerr }
+	_, werr = io.WriteString(w, "\n")
+	return werr
+}
@@ -0,0 +1,205 @@
+package lib
+
+// Podcast mode adds the channel elements podcast apps and directories expect
+// (iTunes and Podcasting 2.0 namespaces) to the RSS output of a compilation.
+// Episode metadata is taken from the original feeds.
+
+import "crypto/sha1"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/url"
+import "regexp"
+import "strings"
+
+type Podcast struct {
+	Enabled		bool			`json:"enabled"`
+	// Artwork, Apple wants a square JPEG or PNG of 1400 to 3000 pixels
+	Image		string			`json:"image"`
+	Author		string			`json:"author"`
+	Owner		PodcastOwner		`json:"owner"`
+	Categories	[]PodcastCategory	`json:"categories,omitempty"`
+	Explicit	bool			`json:"explicit"`
+	Language	string			`json:"language"`
+	// episodic (default) or serial
+	Type		string			`json:"type"`
+	Summary		string			`json:"summary"`
+	Copyright	string			`json:"copyright"`
+	// Asks other platforms not to import the podcast
+	Locked		bool			`json:"locked"`
+	Funding		*PodcastFunding		`json:"funding,omitempty"`
+	// Derived from the URL of the output if not set
+	Guid		string			`json:"guid"`
+}
+
+type PodcastOwner struct {
+	Name		string		`json:"name"`
+	Email		string		`json:"email"`
+}
+
+type PodcastCategory struct {
+	Category	string		`json:"category"`
+	Subcategory	string		`json:"subcategory,omitempty"`
+}
+
+type PodcastFunding struct {
+	Url		string		`json:"url"`
+	Text		string		`json:"text"`
+}
+
+// Top level categories of Apple Podcasts
+var PodcastCategories = []string{"Arts", "Business", "Comedy", "Education", "Fiction", "Government",
+				 "Health & Fitness", "History", "Kids & Family", "Leisure", "Music", "News",
+				 "Religion & Spirituality", "Science", "Society & Culture", "Sports",
+				 "Technology", "True Crime", "TV & Film"}
+
+var podcast_types = []string{"episodic", "serial"}
+
+var language_code = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+var uuid_format = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Namespace for podcast:guid, see https://podcastindex.org/namespace/1.0#guid
+var podcast_guid_namespace = []byte{0xea, 0xd4, 0xc2, 0x36, 0xbf, 0x58, 0x58, 0xc6,
+				    0xa2, 0xc6, 0xa6, 0xb2, 0x8d, 0x12, 0x8c, 0xb6}
+
+// Loads settings as stored in the database
+func Load_podcast (data string) (*Podcast, error) {
+	var p Podcast
+	jsonerr := json.Unmarshal([]byte(data), &p)
+	if jsonerr != nil { return nil, jsonerr }
+	return &p, p.Validate()
+}
+
+func (p *Podcast) Empty () (bool) {
+	return !p.Enabled && p.Image == "" && p.Author == "" && p.Owner == PodcastOwner{} && len(p.Categories) == 0 &&
+	       !p.Explicit && p.Language == "" && p.Type == "" && p.Summary == "" && p.Copyright == "" &&
+	       !p.Locked && p.Funding == nil && p.Guid == ""
+}
+
+func (p *Podcast) Json () (string) {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// Checks the settings, those directories require only if podcast mode is enabled
+func (p *Podcast) Validate () (error) {
+	if p.Enabled {
+		if p.Image == "" { return errors.New("Podcasts need an image") }
+		if len(p.Categories) == 0 { return errors.New("Podcasts need at least one category") }
+	}
+
+	if p.Image != "" && !absolute_http_url(p.Image) { return fmt.Errorf("Invalid podcast image %q", p.Image) }
+	for _, category := range p.Categories {
+		if !contains_string(PodcastCategories, category.Category) {
+			return fmt.Errorf("Unknown podcast category %q, must be one of %s", category.Category, strings.Join(PodcastCategories, ", "))
+		}
+	}
+	if p.Language != "" && !language_code.MatchString(p.Language) { return fmt.Errorf("Invalid podcast language %q", p.Language) }
+	if p.Type != "" && !contains_string(podcast_types, p.Type) {
+		return fmt.Errorf("Podcast type must be one of %s", strings.Join(podcast_types, ", "))
+	}
+	if p.Owner.Email != "" && !strings.Contains(p.Owner.Email, "@") { return fmt.Errorf("Invalid owner email %q", p.Owner.Email) }
+	if p.Locked && p.Owner.Email == "" { return errors.New("Locked podcasts need an owner email") }
+	if p.Funding != nil && !absolute_http_url(p.Funding.Url) { return fmt.Errorf("Invalid funding URL %q", p.Funding.Url) }
+	if p.Guid != "" && !uuid_format.MatchString(p.Guid) { return fmt.Errorf("Invalid podcast guid %q, must be a UUID", p.Guid) }
+
+	return nil
+}
+
+// Returns the podcast:guid of the feed published at `feedurl`, a UUIDv5
+// of the URL without scheme and trailing slashes
+func Podcast_guid (feedurl string) (string) {
+	name := feedurl
+	if i := strings.Index(name, "://"); i >= 0 { name = name[i+3:] }
+	name = strings.TrimRight(name, "/")
+
+	hash := sha1.New()
+	hash.Write(podcast_guid_namespace)
+	hash.Write([]byte(name))
+	sum := hash.Sum(nil)
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func absolute_http_url (s string) (bool) {
+	u, parseerr := url.Parse(s)
+	return parseerr == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+const ns_podcast = "https://podcastindex.org/namespace/1.0"
+
+type rss_image struct {
+	Url		string		`xml:"url"`
+	Title		string		`xml:"title"`
+	Link		string		`xml:"link"`
+}
+
+type xml_itunes_owner struct {
+	Name		string		`xml:"itunes:name,omitempty"`
+	Email		string		`xml:"itunes:email,omitempty"`
+}
+
+type xml_itunes_category struct {
+	Text		string			`xml:"text,attr"`
+	Sub		*xml_itunes_category	`xml:"itunes:category"`
+}
+
+type xml_podcast_locked struct {
+	Owner		string		`xml:"owner,attr,omitempty"`
+	Value		string		`xml:",chardata"`
+}
+
+type xml_podcast_funding struct {
+	Url		string		`xml:"url,attr"`
+	Text		string		`xml:",chardata"`
+}
+
+// Channel level iTunes and Podcasting 2.0 elements
+type xml_podcast_channel struct {
+	Language	string			`xml:"language,omitempty"`
+	Copyright	string			`xml:"copyright,omitempty"`
+	Image		*rss_image		`xml:"image"`
+	ItunesImage	*xml_itunes_image	`xml:"itunes:image"`
+	Author		string			`xml:"itunes:author,omitempty"`
+	Owner		*xml_itunes_owner	`xml:"itunes:owner"`
+	Categories	[]xml_itunes_category	`xml:"itunes:category"`
+	Explicit	string			`xml:"itunes:explicit,omitempty"`
+	Type		string			`xml:"itunes:type,omitempty"`
+	Summary		string			`xml:"itunes:summary,omitempty"`
+	Guid		string			`xml:"podcast:guid,omitempty"`
+	Locked		*xml_podcast_locked	`xml:"podcast:locked"`
+	Funding		*xml_podcast_funding	`xml:"podcast:funding"`
+}
+
+func podcast_elements (p *Podcast, feed *CompiledFeed, feedurl string) (xml_podcast_channel) {
+	result := xml_podcast_channel{Language: p.Language,
+				      Copyright: p.Copyright,
+				      Author: p.Author,
+				      Explicit: "false",
+				      Type: p.Type,
+				      Summary: p.Summary,
+				      Guid: p.Guid}
+	if p.Explicit { result.Explicit = "true" }
+
+	if p.Image != "" {
+		result.Image = &rss_image{Url: p.Image, Title: feed.Title, Link: feed.Link}
+		result.ItunesImage = &xml_itunes_image{Href: p.Image}
+	}
+	if p.Owner != (PodcastOwner{}) { result.Owner = &xml_itunes_owner{Name: p.Owner.Name, Email: p.Owner.Email} }
+
+	for _, category := range p.Categories {
+		out := xml_itunes_category{Text: category.Category}
+		if category.Subcategory != "" { out.Sub = &xml_itunes_category{Text: category.Subcategory} }
+		result.Categories = append(result.Categories, out)
+	}
+
+	if result.Guid == "" && feedurl != "" { result.Guid = Podcast_guid(feedurl) }
+
+	result.Locked = &xml_podcast_locked{Owner: p.Owner.Email, Value: "no"}
+	if p.Locked { result.Locked.Value = "yes" }
+	if p.Funding != nil { result.Funding = &xml_podcast_funding{Url: p.Funding.Url, Text: p.Funding.Text} }
+
+	return result
+}
@@ -0,0 +1,149 @@
+package lib
+
+// Rewrite rules modify the items of a compilation after filtering,
+// deduplication happens before, so it sees the original items
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/url"
+import "regexp"
+import "strings"
+
+type Rewrite struct {
+	// Prefixes titles with the name of the feed the item came from
+	PrefixSource	bool			`json:"prefix_source"`
+	Replace		[]RewriteReplace	`json:"replace,omitempty"`
+	// Removes utm_* and other tracking parameters from links
+	StripTracking	bool			`json:"strip_tracking"`
+	// Replaces the host of links, e.g. to use a privacy frontend
+	Hosts		map[string]string	`json:"hosts,omitempty"`
+	// Resolves relative links and images in description and content
+	AbsoluteUrls	bool			`json:"absolute_urls"`
+}
+
+// Regular expression replacement, `Replacement` may use $1 etc.
+type RewriteReplace struct {
+	Field		string		`json:"field"`
+	Pattern		string		`json:"pattern"`
+	Replacement	string		`json:"replacement"`
+	re		*regexp.Regexp
+}
+
+var rewrite_fields = []string{"title", "description", "content"}
+
+var html_url_attr = regexp.MustCompile(`(?i)(\s(?:href|src)\s*=\s*)("[^"]*"|'[^']*')`)
+
+// Loads rules as stored in the database
+func Load_rewrite (data string) (*Rewrite, error) {
+	var r Rewrite
+	jsonerr := json.Unmarshal([]byte(data), &r)
+	if jsonerr != nil { return nil, jsonerr }
+	return &r, r.Validate()
+}
+
+func (r *Rewrite) Empty () (bool) {
+	return !r.PrefixSource && len(r.Replace) == 0 && !r.StripTracking && len(r.Hosts) == 0 && !r.AbsoluteUrls
+}
+
+func (r *Rewrite) Json () (string) {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// Checks the rules and compiles regular expressions
+func (r *Rewrite) Validate () (error) {
+	for i := range r.Replace {
+		replace := &r.Replace[i]
+		if !contains_string(rewrite_fields, replace.Field) {
+			return fmt.Errorf("Can not rewrite %q, only %s", replace.Field, strings.Join(rewrite_fields, ", "))
+		}
+		if replace.Pattern == "" { return errors.New("Rewrite pattern must not be empty") }
+		re, reerr := regexp.Compile(replace.Pattern)
+		if reerr != nil { return fmt.Errorf("Invalid regular expression %q: %s", replace.Pattern, reerr) }
+		replace.re = re
+	}
+
+	for from, to := range r.Hosts {
+		if from == "" || to == "" || strings.ContainsAny(from+to, "/?#@ ") {
+			return fmt.Errorf("Invalid host rewrite %q to %q", from, to)
+		}
+	}
+
+	return nil
+}
+
+// Applies the rules to `item`. `source` is the name of the feed it came from,
+// `base` the link relative URLs are resolved against if the item has none.
+func (r *Rewrite) Apply (item *CompiledItem, source string, base string) {
+	if r.AbsoluteUrls {
+		if item.Link != "" { base = item.Link }
+		if baseurl, parseerr := url.Parse(base); parseerr == nil && baseurl.IsAbs() {
+			item.Description = absolute_urls(item.Description, baseurl)
+			item.Content = absolute_urls(item.Content, baseurl)
+		}
+	}
+
+	for _, replace := range r.Replace {
+		switch replace.Field {
+		case "title":
+			item.Title = replace.re.ReplaceAllString(item.Title, replace.Replacement)
+		case "description":
+			item.Description = replace.re.ReplaceAllString(item.Description, replace.Replacement)
+		case "content":
+			item.Content = replace.re.ReplaceAllString(item.Content, replace.Replacement)
+		}
+	}
+
+	if r.PrefixSource && source != "" {
+		item.Title = "["+source+"] "+item.Title
+	}
+
+	if item.Link != "" {
+		if r.StripTracking { item.Link = Strip_tracking(item.Link) }
+		if len(r.Hosts) > 0 { item.Link = r.rewrite_host(item.Link) }
+	}
+}
+
+func (r *Rewrite) rewrite_host (link string) (string) {
+	u, parseerr := url.Parse(link)
+	if parseerr != nil { return link }
+
+	for from, to := range r.Hosts {
+		if strings.EqualFold(u.Hostname(), from) {
+			u.Host = to
+			return u.String()
+		}
+	}
+	return link
+}
+
+// Removes tracking parameters from `link`, leaving everything else as is
+func Strip_tracking (link string) (string) {
+	u, parseerr := url.Parse(link)
+	if parseerr != nil || u.RawQuery == "" { return link }
+
+	var kept []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name := param
+		if eq := strings.Index(param, "="); eq >= 0 { name = param[:eq] }
+		if unescaped, unescerr := url.QueryUnescape(name); unescerr == nil { name = unescaped }
+		if !is_tracking_param(name) { kept = append(kept, param) }
+	}
+
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+// Makes `href` and `src` attributes in an HTML fragment absolute
+func absolute_urls (html string, base *url.URL) (string) {
+	return html_url_attr.ReplaceAllStringFunc(html, func(attr string) (string) {
+		parts := html_url_attr.FindStringSubmatch(attr)
+		quote := parts[2][:1]
+		value := parts[2][1:len(parts[2])-1]
+
+		ref, parseerr := url.Parse(strings.TrimSpace(value))
+		if parseerr != nil || ref.IsAbs() || strings.HasPrefix(value, "#") { return attr }
+		return parts[1]+quote+base.ResolveReference(ref).String()+quote
+	})
+}
@@ -0,0 +1,253 @@
+package lib
+
+// Sources are catalogue entries which are not feeds themselves, but get
+// turned into one by fetcher, so compiler can treat them like any other feed
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/PuerkitoBio/goquery"
+import "github.com/andybalholm/cascadia"
+import "github.com/gorilla/feeds"
+
+// Describes where to find the fields of an item
+// For `html` sources these are CSS selectors, relative to `Items`,
+// optionally followed by `@attribute` to use an attribute instead of the text.
+// For `json` sources these are JSONPath expressions, also relative to `Items`.
+type SourceMapping struct {
+	Items		string		`json:"items"`
+	Title		string		`json:"title"`
+	Link		string		`json:"link"`
+	Id		string		`json:"id,omitempty"`
+	Date		string		`json:"date,omitempty"`
+	Summary		string		`json:"summary,omitempty"`
+	Body		string		`json:"body,omitempty"`
+}
+
+type Source struct {
+	Url		string		`json:"url"`
+	Type		string		`json:"type"`
+	Mapping		SourceMapping	`json:"mapping"`
+}
+
+func (s Source) Validate () (error) {
+	if s.Url == "" { return errors.New("Source has no URL") }
+
+	switch s.Type {
+	case "html":
+		if s.Mapping.Items == "" || s.Mapping.Title == "" {
+			return errors.New("Mapping needs at least `items` and `title`")
+		}
+		for _, selector := range []string{s.Mapping.Items, s.Mapping.Title, s.Mapping.Link, s.Mapping.Date, s.Mapping.Summary} {
+			if selector == "" { continue }
+			_, compileerr := cascadia.Compile(split_selector(selector))
+			if compileerr != nil { return fmt.Errorf("Invalid selector %q: %s", selector, compileerr) }
+		}
+	case "json":
+		if s.Mapping.Items == "" || s.Mapping.Title == "" {
+			return errors.New("Mapping needs at least `items` and `title`")
+		}
+		for _, path := range []string{s.Mapping.Items, s.Mapping.Title, s.Mapping.Link, s.Mapping.Id, s.Mapping.Date, s.Mapping.Summary, s.Mapping.Body} {
+			if path == "" { continue }
+			_, parseerr := parse_jsonpath(path)
+			if parseerr != nil { return fmt.Errorf("Invalid JSONPath %q: %s", path, parseerr) }
+		}
+	default:
+		return fmt.Errorf("Unknown source type %q", s.Type)
+	}
+
+	return nil
+}
+
+// Turns an HTML page into an RSS feed, using the CSS selectors in `mapping`
+func Scrape_html (body io.Reader, base *url.URL, mapping SourceMapping) ([]byte, error) {
+	doc, parseerr := goquery.NewDocumentFromReader(body)
+	if parseerr != nil { return nil, parseerr }
+
+	output := &feeds.Feed{Title: strings.TrimSpace(doc.Find("title").First().Text()),
+			      Link: &feeds.Link{Href: base.String()},
+			      Created: time.Now()}
+
+	doc.Find(mapping.Items).Each(func(i int, item *goquery.Selection) {
+		var next feeds.Item
+		next.Title = select_value(item, mapping.Title, "")
+		if next.Title == "" { return }
+
+		link := select_value(item, mapping.Link, "href")
+		if link != "" {
+			href, hreferr := base.Parse(link)
+			if hreferr == nil { link = href.String() }
+		}
+		// gorilla/feeds expects every item to have one, even if empty
+		next.Link = &feeds.Link{Href: link}
+
+		if mapping.Date != "" {
+			// <time> elements carry a machine-readable date
+			date, dateerr := Parse_date(select_value(item, mapping.Date, "datetime"))
+			if dateerr == nil { next.Created = date }
+		}
+
+		// The markup of the element, unless an attribute is selected
+		if mapping.Summary != "" && split_selector(mapping.Summary) != mapping.Summary {
+			next.Description = select_value(item, mapping.Summary, "")
+		} else if mapping.Summary != "" {
+			next.Description, _ = item.Find(mapping.Summary).First().Html()
+		}
+
+		// Pages have no GUIDs, so the link has to do
+		next.Id = link
+		if next.Id == "" { next.Id = fmt.Sprintf("%x", sha256.Sum256([]byte(next.Title))) }
+
+		output.Items = append(output.Items, &next)
+	})
+
+	if len(output.Items) == 0 { return nil, errors.New("No items found with the configured selectors") }
+
+	var buf bytes.Buffer
+	werr := output.WriteRss(&buf)
+	return buf.Bytes(), werr
+}
+
+// Turns a JSON document into an RSS feed, using the JSONPath expressions in `mapping`
+func Map_json (body io.Reader, base *url.URL, mapping SourceMapping) ([]byte, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(body)
+	// Keeps large numeric IDs intact
+	decoder.UseNumber()
+	jderr := decoder.Decode(&doc)
+	if jderr != nil { return nil, jderr }
+
+	items, patherr := Jsonpath(doc, mapping.Items)
+	if patherr != nil { return nil, patherr }
+	// `$.items` matches the array itself, `$.items[*]` its elements
+	if len(items) == 1 {
+		if array, ok := items[0].([]interface{}); ok { items = array }
+	}
+
+	output := &feeds.Feed{Title: base.String(),
+			      Link: &feeds.Link{Href: base.String()},
+			      Created: time.Now()}
+
+	for _, item := range items {
+		var next feeds.Item
+		next.Title = json_value(item, mapping.Title)
+		if next.Title == "" { continue }
+
+		link := json_value(item, mapping.Link)
+		if link != "" {
+			href, hreferr := base.Parse(link)
+			if hreferr == nil { link = href.String() }
+		}
+		// gorilla/feeds expects every item to have one, even if empty
+		next.Link = &feeds.Link{Href: link}
+
+		next.Id = json_value(item, mapping.Id)
+		if next.Id == "" { next.Id = link }
+		if next.Id == "" { next.Id = fmt.Sprintf("%x", sha256.Sum256([]byte(next.Title))) }
+
+		if mapping.Date != "" {
+			date, dateerr := json_date(item, mapping.Date)
+			if dateerr == nil { next.Created = date }
+		}
+
+		next.Description = json_value(item, mapping.Summary)
+		next.Content = json_value(item, mapping.Body)
+
+		output.Items = append(output.Items, &next)
+	}
+
+	if len(output.Items) == 0 { return nil, errors.New("No items found with the configured JSONPath") }
+
+	var buf bytes.Buffer
+	werr := output.WriteRss(&buf)
+	return buf.Bytes(), werr
+}
+
+// Returns the first value matching `path` as a string
+func json_value (item interface{}, path string) (string) {
+	if path == "" { return "" }
+
+	values, patherr := Jsonpath(item, path)
+	if patherr != nil || len(values) == 0 { return "" }
+
+	switch value := values[0].(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(value)
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		// Objects and arrays are returned as JSON
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// Dates in APIs are either strings or Unix timestamps (seconds or milliseconds)
+func json_date (item interface{}, path string) (time.Time, error) {
+	values, patherr := Jsonpath(item, path)
+	if patherr != nil { return time.Time{}, patherr }
+	if len(values) == 0 { return time.Time{}, errors.New("No date found") }
+
+	if number, ok := values[0].(json.Number); ok {
+		epoch, converr := number.Int64()
+		if converr != nil { return time.Time{}, converr }
+		if epoch > 100000000000 { return time.Unix(0, epoch * int64(time.Millisecond)), nil }
+		return time.Unix(epoch, 0), nil
+	}
+
+	return Parse_date(json_value(item, path))
+}
+
+// Returns the trimmed text of the first element matching `selector`.
+// `selector@attr` returns an attribute instead, `fallback` is tried as
+// attribute before falling back to the text.
+func select_value (s *goquery.Selection, selector string, fallback string) (string) {
+	if selector == "" { return "" }
+
+	attr := ""
+	if at := strings.LastIndex(selector, "@"); at > 0 {
+		attr = selector[at+1:]
+	}
+
+	match := s.Find(split_selector(selector)).First()
+	if attr != "" { return strings.TrimSpace(match.AttrOr(attr, "")) }
+	if fallback != "" {
+		if value, exists := match.Attr(fallback); exists { return strings.TrimSpace(value) }
+	}
+
+	return strings.TrimSpace(match.Text())
+}
+
+// Removes a trailing `@attribute` from a selector
+func split_selector (selector string) (string) {
+	if at := strings.LastIndex(selector, "@"); at > 0 {
+		return selector[:at]
+	}
+	return selector
+}
+
+// Tries the date formats commonly found on web pages and in APIs
+func Parse_date (s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, time.RFC3339Nano, time.RFC1123Z, time.RFC1123,
+					time.RFC822Z, time.RFC822, time.RFC850, time.ANSIC,
+					"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02",
+					"January 2, 2006", "Jan 2, 2006", "2 January 2006", "02.01.2006"} {
+		t, perr := time.Parse(layout, s)
+		if perr == nil { return t, nil }
+	}
+
+	return time.Time{}, fmt.Errorf("Unknown date format %q", s)
+}
@@ -0,0 +1,60 @@
+package lib
+
+import "net/url"
+import "strings"
+import "testing"
+
+import "github.com/mmcdole/gofeed"
+
+func TestScrapeHtml (t *testing.T) {
+	page := `<html><head><title>Listing</title></head><body>
+		<article><h2><a href="/post/1?ref=list">First</a></h2><time datetime="2021-03-01T10:00:00Z">March 1</time>
+			 <p class="teaser">Some <b>bold</b> words</p><img src="/1.png" alt="Picture of the first post"></article>
+		<article><h2><a href="/post/2?ref=list">Second</a></h2><time datetime="2021-03-02T10:00:00Z">March 2</time>
+			 <p class="teaser">More words</p><img src="/2.png" alt="Picture of the second post"></article>
+		</body></html>`
+	base, _ := url.Parse("https://example.com/search?tag=go&page=2")
+
+	for _, test := range []struct {
+		summary		string
+		want		string
+	}{
+		{"p.teaser", "Some <b>bold</b> words"},
+		{"img@alt", "Picture of the first post"},
+	} {
+		mapping := SourceMapping{Items: "article", Title: "h2 a", Link: "h2 a", Date: "time", Summary: test.summary}
+		if validerr := (Source{Url: base.String(), Type: "html", Mapping: mapping}).Validate(); validerr != nil { t.Fatal(validerr) }
+
+		output, scrapeerr := Scrape_html(strings.NewReader(page), base, mapping)
+		if scrapeerr != nil { t.Fatal(scrapeerr) }
+		feed, parseerr := gofeed.NewParser().ParseString(string(output))
+		if parseerr != nil { t.Fatal(parseerr) }
+
+		if len(feed.Items) != 2 { t.Fatalf("Found %d items, want 2", len(feed.Items)) }
+		item := feed.Items[0]
+		if item.Title != "First" || item.Link != "https://example.com/post/1?ref=list" { t.Errorf("First item is %q at %s", item.Title, item.Link) }
+		if item.Description != test.want { t.Errorf("Summary %q selects %q, want %q", test.summary, item.Description, test.want) }
+	}
+}
+
+func TestMapJsonWithoutLink (t *testing.T) {
+	base, _ := url.Parse("https://example.com/api/items?status=open")
+	mapping := SourceMapping{Items: "$.items[*]", Title: "$.title"}
+
+	output, maperr := Map_json(strings.NewReader(`{"items":[{"title":"First"},{"title":"Second"}]}`), base, mapping)
+	if maperr != nil { t.Fatal(maperr) }
+	feed, parseerr := gofeed.NewParser().ParseString(string(output))
+	if parseerr != nil { t.Fatal(parseerr) }
+	if len(feed.Items) != 2 || feed.Items[0].Title != "First" { t.Errorf("Mapped %d items", len(feed.Items)) }
+}
+
+func TestScrapeHtmlWithoutLink (t *testing.T) {
+	base, _ := url.Parse("https://example.com/news")
+	mapping := SourceMapping{Items: "li", Title: "span"}
+
+	output, scrapeerr := Scrape_html(strings.NewReader(`<ul><li><span>First</span></li><li><span>Second</span></li></ul>`), base, mapping)
+	if scrapeerr != nil { t.Fatal(scrapeerr) }
+	feed, parseerr := gofeed.NewParser().ParseString(string(output))
+	if parseerr != nil { t.Fatal(parseerr) }
+	if len(feed.Items) != 2 || feed.Items[0].Title != "First" { t.Errorf("Scraped %d items", len(feed.Items)) }
+}
@@ -0,0 +1,384 @@
+package lib
+
+// Storage for downloaded feeds, shared by fetcher, compiler and api.
+// Keys are relative paths like `a/b/<hash>`, as stored in `feed.filename`.
+
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/xml"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+import "github.com/knadh/koanf"
+
+type Storage interface {
+	// Replaces the object atomically, readers never see partial data
+	Put (key string, r io.Reader) (int64, error)
+	Get (key string) (io.ReadCloser, error)
+	Exists (key string) (bool)
+	Delete (key string) (error)
+	List () ([]StoredObject, error)
+}
+
+type StoredObject struct {
+	Key		string
+	Size		int64
+	Modified	time.Time
+}
+
+// Returns the storage backend configured in `storage.type`
+func OpenStorage (k *koanf.Koanf, db *sqlx.DB) (Storage, error) {
+	switch k.String("storage.type") {
+	case "", "filesystem":
+		root := k.String("storage.path")
+		if root == "" { root = k.String("workdir") }
+		if root == "" { root = os.Getenv("HOME") }
+		return &FileStorage{Root: root}, nil
+	case "database":
+		return &DatabaseStorage{DB: db}, nil
+	case "s3":
+		s3 := &S3Storage{Endpoint: strings.TrimSuffix(k.String("storage.s3.endpoint"), "/"),
+				 Bucket: k.String("storage.s3.bucket"),
+				 Region: Value_or_default(k.String("storage.s3.region"), "us-east-1").(string),
+				 AccessKey: k.String("storage.s3.accesskey"),
+				 SecretKey: k.String("storage.s3.secretkey"),
+				 Client: &http.Client{Timeout: 30 * time.Second},
+				 // Enclosures can take a while
+				 Transfer: &http.Client{Timeout: time.Duration(Value_or_default(k.Int("storage.s3.timeout"), 3600).(int)) * time.Second}}
+		if s3.Endpoint == "" || s3.Bucket == "" { return nil, errors.New("S3 storage needs `storage.s3.endpoint` and `storage.s3.bucket`") }
+		return s3, nil
+	}
+
+	return nil, fmt.Errorf("Unknown storage type %q", k.String("storage.type"))
+}
+
+// Stores objects as files below `Root`
+// Absolute keys (from before storage was configurable) are used as they are
+type FileStorage struct {
+	Root		string
+}
+
+func (fs *FileStorage) path (key string) (string) {
+	if filepath.IsAbs(key) { return key }
+	return filepath.Join(fs.Root, key)
+}
+
+func (fs *FileStorage) Put (key string, r io.Reader) (int64, error) {
+	target := fs.path(key)
+	direrr := os.MkdirAll(filepath.Dir(target), 0755)
+	if direrr != nil { return -1, direrr }
+
+	fh, fherr := ioutil.TempFile(filepath.Dir(target), ".tmp-")
+	if fherr != nil { return -1, fherr }
+	// Once renamed, this is a no-op
+	defer os.Remove(fh.Name())
+
+	written, copyerr := io.Copy(fh, r)
+	if copyerr != nil {
+		fh.Close()
+		return -1, copyerr
+	}
+
+	closeerr := fh.Close()
+	if closeerr != nil { return -1, closeerr }
+
+	chmoderr := os.Chmod(fh.Name(), 0644)
+	if chmoderr != nil { return -1, chmoderr }
+
+	return written, os.Rename(fh.Name(), target)
+}
+
+func (fs *FileStorage) Get (key string) (io.ReadCloser, error) {
+	return os.Open(fs.path(key))
+}
+
+func (fs *FileStorage) Exists (key string) (bool) {
+	return File_exists(fs.path(key))
+}
+
+func (fs *FileStorage) Delete (key string) (error) {
+	return os.Remove(fs.path(key))
+}
+
+func (fs *FileStorage) List () ([]StoredObject, error) {
+	var result []StoredObject
+
+	walkerr := filepath.Walk(fs.Root, func(path string, info os.FileInfo, err error) (error) {
+		if err != nil { return err }
+		// Skip hidden directories, temporary files and directories themselves
+		if info.IsDir() && path != fs.Root && strings.HasPrefix(info.Name(), ".") { return filepath.SkipDir }
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") { return nil }
+
+		key, relerr := filepath.Rel(fs.Root, path)
+		if relerr != nil { return relerr }
+		result = append(result, StoredObject{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+
+	return result, walkerr
+}
+
+// Stores objects as blobs in the `storage` table
+type DatabaseStorage struct {
+	DB		*sqlx.DB
+}
+
+func (ds *DatabaseStorage) Put (key string, r io.Reader) (int64, error) {
+	data, readerr := ioutil.ReadAll(r)
+	if readerr != nil { return -1, readerr }
+
+	tx, txerr := ds.DB.Begin()
+	if txerr != nil { return -1, txerr }
+	defer tx.Rollback()
+
+	_, execerr := tx.Exec("DELETE FROM storage WHERE name = ?", key)
+	if execerr != nil { return -1, execerr }
+	_, execerr = tx.Exec("INSERT INTO storage (name, data, modified) VALUES (?,?,?)", key, data, time.Now().Unix())
+	if execerr != nil { return -1, execerr }
+
+	return int64(len(data)), tx.Commit()
+}
+
+func (ds *DatabaseStorage) Get (key string) (io.ReadCloser, error) {
+	var data []byte
+	scanerr := ds.DB.QueryRow("SELECT data FROM storage WHERE name = ?", key).Scan(&data)
+	if scanerr != nil { return nil, scanerr }
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ds *DatabaseStorage) Exists (key string) (bool) {
+	var count int64
+	scanerr := ds.DB.QueryRow("SELECT COUNT(*) FROM storage WHERE name = ?", key).Scan(&count)
+	return scanerr == nil && count > 0
+}
+
+func (ds *DatabaseStorage) Delete (key string) (error) {
+	_, execerr := ds.DB.Exec("DELETE FROM storage WHERE name = ?", key)
+	return execerr
+}
+
+func (ds *DatabaseStorage) List () ([]StoredObject, error) {
+	var result []StoredObject
+
+	rows, qerr := ds.DB.Query("SELECT name, LENGTH(data), COALESCE(modified,0) FROM storage")
+	if qerr != nil { return result, qerr }
+	defer rows.Close()
+
+	for rows.Next() {
+		var object StoredObject
+		var modified int64
+		scanerr := rows.Scan(&object.Key, &object.Size, &modified)
+		if scanerr != nil { return result, scanerr }
+		object.Modified = time.Unix(modified, 0)
+		result = append(result, object)
+	}
+
+	return result, rows.Err()
+}
+
+// Stores objects in an S3-compatible bucket, using path-style requests
+// and AWS Signature Version 4
+type S3Storage struct {
+	Endpoint	string
+	Bucket		string
+	Region		string
+	AccessKey	string
+	SecretKey	string
+	// For requests without a body
+	Client		*http.Client
+	// For uploads and downloads of objects
+	Transfer	*http.Client
+}
+
+func (s3 *S3Storage) Put (key string, r io.Reader) (int64, error) {
+	// Signing needs hash and length of the body up front, so anything
+	// but a file is spooled to disk instead of being kept in memory
+	fh, isfile := r.(*os.File)
+	if !isfile {
+		tmpfile, tmperr := ioutil.TempFile("", "rssmix-s3-")
+		if tmperr != nil { return -1, tmperr }
+		defer os.Remove(tmpfile.Name())
+		defer tmpfile.Close()
+		_, copyerr := io.Copy(tmpfile, r)
+		if copyerr != nil { return -1, copyerr }
+		_, seekerr := tmpfile.Seek(0, io.SeekStart)
+		if seekerr != nil { return -1, seekerr }
+		fh = tmpfile
+	}
+
+	start, seekerr := fh.Seek(0, io.SeekCurrent)
+	if seekerr != nil { return -1, seekerr }
+	hash := sha256.New()
+	size, hasherr := io.Copy(hash, fh)
+	if hasherr != nil { return -1, hasherr }
+	_, seekerr = fh.Seek(start, io.SeekStart)
+	if seekerr != nil { return -1, seekerr }
+
+	response, reqerr := s3.send(s3.Transfer, "PUT", key, nil, ioutil.NopCloser(fh), size, hex.EncodeToString(hash.Sum(nil)))
+	if reqerr != nil { return -1, reqerr }
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK { return -1, fmt.Errorf("S3 PUT failed: %s", response.Status) }
+	return size, nil
+}
+
+func (s3 *S3Storage) Get (key string) (io.ReadCloser, error) {
+	response, reqerr := s3.send(s3.Transfer, "GET", key, nil, nil, 0, sha256hex(nil))
+	if reqerr != nil { return nil, reqerr }
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("S3 GET failed: %s", response.Status)
+	}
+	return response.Body, nil
+}
+
+func (s3 *S3Storage) Exists (key string) (bool) {
+	response, reqerr := s3.request("HEAD", key, nil, nil)
+	if reqerr != nil { return false }
+	response.Body.Close()
+
+	return response.StatusCode == http.StatusOK
+}
+
+func (s3 *S3Storage) Delete (key string) (error) {
+	response, reqerr := s3.request("DELETE", key, nil, nil)
+	if reqerr != nil { return reqerr }
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 DELETE failed: %s", response.Status)
+	}
+	return nil
+}
+
+func (s3 *S3Storage) List () ([]StoredObject, error) {
+	var result []StoredObject
+
+	type ListBucketResult struct {
+		Contents	[]struct {
+			Key		string
+			Size		int64
+			LastModified	time.Time
+		}
+		IsTruncated		bool
+		NextContinuationToken	string
+	}
+
+	query := url.Values{"list-type": {"2"}}
+	for {
+		response, reqerr := s3.request("GET", "", query, nil)
+		if reqerr != nil { return result, reqerr }
+
+		var page ListBucketResult
+		xmlerr := xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK { return result, fmt.Errorf("S3 LIST failed: %s", response.Status) }
+		if xmlerr != nil { return result, xmlerr }
+
+		for _, object := range page.Contents {
+			result = append(result, StoredObject{Key: object.Key, Size: object.Size, Modified: object.LastModified})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" { return result, nil }
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s3 *S3Storage) request (method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	return s3.send(s3.Client, method, key, query, bytes.NewReader(body), int64(len(body)), sha256hex(body))
+}
+
+// Signs and sends a request, `payloadhash` is the hex SHA-256 of the `length` bytes of `body`
+func (s3 *S3Storage) send (client *http.Client, method string, key string, query url.Values, body io.Reader, length int64, payloadhash string) (*http.Response, error) {
+	endpoint, parseerr := url.Parse(s3.Endpoint)
+	if parseerr != nil { return nil, parseerr }
+
+	now := time.Now().UTC()
+	amzdate := now.Format("20060102T150405Z")
+	shortdate := now.Format("20060102")
+
+	canonicaluri := s3_escape_path("/"+s3.Bucket+"/"+strings.TrimPrefix(key, "/"))
+	canonicalquery := s3_canonical_query(query)
+
+	canonicalrequest := strings.Join([]string{method,
+						  canonicaluri,
+						  canonicalquery,
+						  "host:"+endpoint.Host+"\nx-amz-content-sha256:"+payloadhash+"\nx-amz-date:"+amzdate+"\n",
+						  "host;x-amz-content-sha256;x-amz-date",
+						  payloadhash}, "\n")
+
+	scope := shortdate+"/"+s3.Region+"/s3/aws4_request"
+	stringtosign := "AWS4-HMAC-SHA256\n"+amzdate+"\n"+scope+"\n"+sha256hex([]byte(canonicalrequest))
+
+	signingkey := hmac_sha256([]byte("AWS4"+s3.SecretKey), shortdate)
+	signingkey = hmac_sha256(signingkey, s3.Region)
+	signingkey = hmac_sha256(signingkey, "s3")
+	signingkey = hmac_sha256(signingkey, "aws4_request")
+	signature := hex.EncodeToString(hmac_sha256(signingkey, stringtosign))
+
+	target := endpoint.Scheme+"://"+endpoint.Host+canonicaluri
+	if canonicalquery != "" { target += "?"+canonicalquery }
+
+	// S3 does not accept chunked uploads, so the length has to be set
+	// explicitly, net/http only knows it for in-memory bodies
+	if length == 0 { body = nil }
+	request, reqerr := http.NewRequest(method, target, body)
+	if reqerr != nil { return nil, reqerr }
+	if body != nil { request.ContentLength = length }
+	request.Header.Set("X-Amz-Date", amzdate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadhash)
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3.AccessKey+"/"+scope+
+					    ", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+signature)
+
+	return client.Do(request)
+}
+
+// S3 wants everything but unreserved characters and `/` escaped, and spaces as %20
+func s3_escape_path (path string) (string) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3_canonical_query (query url.Values) (string) {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, strings.Replace(url.QueryEscape(key), "+", "%20", -1)+"="+strings.Replace(url.QueryEscape(value), "+", "%20", -1))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256hex (data []byte) (string) {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmac_sha256 (key []byte, data string) ([]byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
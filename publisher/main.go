@@ -18,11 +18,15 @@ var version string
 var database *sqlx.DB
 var k = koanf.New(".")
 
+// Metrics
+var publish_attempts = lib.NewCounter("rssmix_publish_total", "Publish attempts by result", "result")
+
 // Custom types
 type PublishItem struct {
 	Id		string
 	Filename	string
 	URL		string
+	Formats		[]string
 }
 
 func main() {
@@ -42,6 +46,8 @@ func main() {
 	var publishcmd string = k.String("publish.command")
 	if publishcmd == "" { log.Fatal("No publish command configured") }
 
+	lib.Serve_metrics(lib.Value_or_default(k.String("metrics.listen"), "127.0.0.1:9813").(string))
+
 	for {
 		// We enter an endless loop here
 		queue := compilations_to_publish()
@@ -52,16 +58,23 @@ func main() {
 		}
 
 		for _, item := range queue {
-			cmd := exec.Command(publishcmd, item.Filename, item.URL)
-			cmderr := cmd.Run()
+			// Every output format is a file of its own
+			var cmderr error
+			for _, format := range item.Formats {
+				cmd := exec.Command(publishcmd, lib.Format_path(item.Filename, format), lib.Format_path(item.URL, format))
+				cmderr = cmd.Run()
+				if cmderr != nil { break }
+			}
 			if cmderr == nil {
 				log.Printf("[%s] Published successfully\n", item.Id)
+				publish_attempts.Inc("success")
 				pubok, puberr := published_successfully(item.Id)
 				if !pubok {
 					log.Printf("[%s] Database error: %s\n", item.Id, puberr)
 				}
 			} else {
 				log.Printf("[%s] Publishing failed with error: %s\n", item.Id, cmderr.Error())
+				publish_attempts.Inc("failure")
 			}
 		}
 
@@ -72,7 +85,7 @@ func main() {
 func compilations_to_publish () ([]PublishItem) {
 	var result []PublishItem
 
-	rows, ferr := database.Query(`SELECT compilation.id, compilation.filename, compilation.url FROM compilation_status
+	rows, ferr := database.Query(`SELECT compilation.id, compilation.filename, compilation.url, COALESCE(compilation.formats,'') FROM compilation_status
 				      INNER JOIN compilation ON compilation_status.id = compilation.id
 				      WHERE compilation_status.published < compilation_status.updated OR compilation_status.published IS NULL`)
 	if ferr != nil {
@@ -84,9 +97,10 @@ func compilations_to_publish () ([]PublishItem) {
 		var cplid string
 		var filename string
 		var url string
-		scanerr := rows.Scan(&cplid, &filename, &url)
+		var formats string
+		scanerr := rows.Scan(&cplid, &filename, &url, &formats)
 		if scanerr == nil {
-			result = append(result, PublishItem{Id: cplid, Filename: filename, URL: url})
+			result = append(result, PublishItem{Id: cplid, Filename: filename, URL: url, Formats: lib.Parse_formats(formats)})
 		} else {
 			log.Println(scanerr)
 		}